@@ -0,0 +1,97 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ImageInventorySpec defines the desired state of ImageInventory
+type ImageInventorySpec struct {
+	// NamespaceSelector selects the namespaces whose Pods are inventoried, all namespaces when empty.
+	// +optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+
+	// Mirror creates a Mirror that copies the inventoried images, and a new one whenever they change.
+	// +optional
+	Mirror *InventoryMirror `json:"mirror,omitempty"`
+}
+
+type InventoryMirror struct {
+	// TargetPrefix is prepended to the registry and path of the images, e.g. myregistry/mirror
+	// mirrors nginx:1.25 to myregistry/mirror/docker.io/library/nginx:1.25.
+	// +kubebuilder:validation:MinLength=1
+	TargetPrefix string `json:"targetPrefix"`
+
+	// +kubebuilder:validation:Enum=pull;copy
+	// +kubebuilder:default:=copy
+	Mode MirrorMode `json:"mode,omitempty"`
+
+	// +kubebuilder:default:=5
+	Parallelism int32 `json:"parallelism,omitempty"`
+
+	DockerConfig *corev1.SecretVolumeSource `json:"dockerConfig,omitempty"`
+}
+
+// ImageInventoryStatus defines the observed state of ImageInventory
+type ImageInventoryStatus struct {
+	// Images are the distinct images used by the Pods, sorted by name.
+	Images []InventoryImage `json:"images,omitempty"`
+
+	// Mirror is the name of the Mirror of the current images.
+	Mirror string `json:"mirror,omitempty"`
+
+	LastUpdateTime *metav1.Time `json:"lastUpdateTime,omitempty"`
+}
+
+type InventoryImage struct {
+	Image string `json:"image"`
+	// Pods is the number of Pods using the image.
+	Pods int32 `json:"pods"`
+	// Skipped is the reason the image is left out of the Mirror, e.g. it is pulled by digest only.
+	// +optional
+	Skipped string `json:"skipped,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Images",type="number",JSONPath=".status.images.length"
+//+kubebuilder:printcolumn:name="Mirror",type="string",JSONPath=".status.mirror"
+//+kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+
+// ImageInventory is the Schema for the imageinventories API
+type ImageInventory struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ImageInventorySpec   `json:"spec,omitempty"`
+	Status ImageInventoryStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// ImageInventoryList contains a list of ImageInventory
+type ImageInventoryList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ImageInventory `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ImageInventory{}, &ImageInventoryList{})
+}
@@ -29,7 +29,15 @@ import (
 type MirrorSpec struct {
 	Images []MirrorImage `json:"images"`
 
-	// +kubebuilder:default:=5
+	// Mode is how images are mirrored: pull saves the image to an OCI layout on an emptyDir and pushes it,
+	// copy streams the blobs from the source to the target, mounting them when both are in the same registry.
+	// +kubebuilder:validation:Enum=pull;copy
+	// +kubebuilder:default:=pull
+	Mode MirrorMode `json:"mode,omitempty"`
+
+	// Parallelism is how many images are mirrored at once, at most the number of images.
+	// Defaults to 5, or to the number of images when there are fewer.
+	// +optional
 	Parallelism int32 `json:"parallelism,omitempty"`
 
 	Resources    *corev1.ResourceRequirements `json:"resources,omitempty"`
@@ -40,8 +48,33 @@ type MirrorSpec struct {
 	// +kubebuilder:default:=3600
 	ActiveDeadlineSeconds *int64 `json:"activeDeadlineSeconds,omitempty"`
 
+	// BackoffLimitPerIndex is how many times the pod of an image that failed with a transient error is retried,
+	// without failing the other images. Errors retrying can't fix fail the image at once.
+	// Needs the JobBackoffLimitPerIndex feature of Kubernetes, enabled by default since 1.29.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	BackoffLimitPerIndex *int32 `json:"backoffLimitPerIndex,omitempty"`
+
+	// TTLSecondsAfterFinished is how long the Mirror is kept after it finished, 0 keeps it forever.
+	// Defaults to the --clean-finished-mirror flag of the operator.
+	// It is ignored for the Mirrors of a MirrorSchedule or an ImageInventory, which delete them themselves.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	TTLSecondsAfterFinished *int32 `json:"ttlSecondsAfterFinished,omitempty"`
+
+	// DockerConfig is used for both the source and the target, prefer sourceCredentials and targetCredentials.
 	DockerConfig *corev1.SecretVolumeSource `json:"dockerConfig,omitempty"`
 
+	// SourceCredentials are given to the containers that read the source images: pull, check and copy,
+	// and push when an image sets copyReferrers.
+	// +optional
+	SourceCredentials []RegistryCredential `json:"sourceCredentials,omitempty"`
+
+	// TargetCredentials are given to the containers that read or push the target images: push, check and copy,
+	// never to pull.
+	// +optional
+	TargetCredentials []RegistryCredential `json:"targetCredentials,omitempty"`
+
 	Verbose bool `json:"verbose,omitempty"`
 
 	SetSourceAnnotation bool `json:"setSourceAnnotation,omitempty"`
@@ -51,11 +84,88 @@ type MirrorSpec struct {
 	PushUseProxy bool `json:"pushUseProxy,omitempty"`
 }
 
+// RegistryCredential references a kubernetes.io/dockerconfigjson Secret in the namespace of the Mirror.
+type RegistryCredential struct {
+	SecretName string `json:"secretName"`
+
+	// Registries restricts the credentials to these registries, e.g. docker.io or myregistry:5000.
+	// All the registries of the Secret are used when empty.
+	// +optional
+	Registries []string `json:"registries,omitempty"`
+}
+
+type MirrorMode string
+
+const (
+	MirrorModePull MirrorMode = "pull"
+	MirrorModeCopy MirrorMode = "copy"
+)
+
 type MirrorImage struct {
-	Source    string   `json:"source"`
-	Target    string   `json:"target"`
+	Source string `json:"source"`
+	// +optional
+	Target string `json:"target,omitempty"`
+	// Targets are more targets the source is pushed to, it is pulled once for all of them.
+	// +optional
+	Targets   []string `json:"targets,omitempty"`
 	Tags      []string `json:"tags,omitempty"`
 	Platforms []string `json:"platforms,omitempty"`
+
+	// PreserveIndex mirrors the image index (manifest list) of the source instead of a single platform image.
+	// When platforms is empty the whole index is copied and keeps its digest, otherwise only the listed
+	// platforms are kept in a new index.
+	PreserveIndex bool `json:"preserveIndex,omitempty"`
+
+	// TagSelector selects tags from the tag list of the source repository, in addition to tags.
+	// +optional
+	TagSelector *TagSelector `json:"tagSelector,omitempty"`
+
+	// CopyReferrers also copies the artifacts attached to the image once it is mirrored: the OCI referrers
+	// such as SBOMs and attestations, and the cosign signature, attestation and SBOM tags (sha256-<digest>.sig).
+	// It can't be set with setSourceAnnotation, since the annotation changes the digest the artifacts are attached to.
+	CopyReferrers bool `json:"copyReferrers,omitempty"`
+}
+
+// DefaultMirrorParallelism is the parallelism of a Mirror that doesn't set it.
+const DefaultMirrorParallelism = 5
+
+// ImageCount returns how many images are mirrored by the Job of the spec, one per tag of each image.
+// ok is false when an image has a tagSelector, its tags are only known once they are resolved.
+func (s *MirrorSpec) ImageCount() (count int32, ok bool) {
+	for _, image := range s.Images {
+		if image.TagSelector != nil {
+			return 0, false
+		}
+
+		count += max(int32(len(image.Tags)), 1)
+	}
+
+	return count, true
+}
+
+// AllTargets returns target followed by targets.
+func (m *MirrorImage) AllTargets() []string {
+	if m.Target == "" {
+		return m.Targets
+	}
+
+	return append([]string{m.Target}, m.Targets...)
+}
+
+// TagSelector selects the tags of a repository, all the set fields must match.
+type TagSelector struct {
+	// Regex matches the tags to mirror.
+	Regex string `json:"regex,omitempty"`
+
+	// SemverRange is a semver constraint such as ">=1.24 <2", tags that are not versions don't match.
+	SemverRange string `json:"semverRange,omitempty"`
+
+	// Latest keeps only the N highest versions, tags that are not versions don't match.
+	// +kubebuilder:validation:Minimum=1
+	Latest *int32 `json:"latest,omitempty"`
+
+	// Exclude are regexes of the tags that are never mirrored.
+	Exclude []string `json:"exclude,omitempty"`
 }
 
 // MirrorStatus defines the observed state of Mirror
@@ -63,12 +173,24 @@ type MirrorStatus struct {
 	Conditions []metav1.Condition `json:"conditions,omitempty"`
 	Images     []ImageStatus      `json:"images,omitempty"`
 
+	// ResolvedTags are the tags selected by the tagSelector of the images, resolved before the Job is created.
+	ResolvedTags []ResolvedTags `json:"resolvedTags,omitempty"`
+
 	// +kubebuilder:default:=0
 	Running int32 `json:"running"`
 	// +kubebuilder:default:=0
 	Failed int32 `json:"failed"`
 	// +kubebuilder:default:=0
 	Succeeded int32 `json:"succeeded"`
+
+	// Retries is how many times the failed images were retried with the retry-failed annotation.
+	Retries int32 `json:"retries,omitempty"`
+}
+
+type ResolvedTags struct {
+	// Image is the index of the image in spec.images.
+	Image int32    `json:"image"`
+	Tags  []string `json:"tags"`
 }
 
 type ImageStatus struct {
@@ -78,6 +200,29 @@ type ImageStatus struct {
 	LastTransitionTime metav1.Time `json:"lastTransitionTime"`
 	Message            string      `json:"message,omitempty"`
 	Pod                string      `json:"pod,omitempty"`
+
+	// Platforms are the platforms that were copied to the target.
+	Platforms []string `json:"platforms,omitempty"`
+	// Digest is the digest found in both the source and the target when the image was skipped.
+	Digest string `json:"digest,omitempty"`
+	// SourceDigest is the digest of the source that was mirrored.
+	SourceDigest string `json:"sourceDigest,omitempty"`
+	// TargetDigest is the digest of the target once it is mirrored.
+	TargetDigest string `json:"targetDigest,omitempty"`
+	// Size is the compressed size in bytes of the layers and configs of the target.
+	Size int64 `json:"size,omitempty"`
+	// Layers is the number of layers of the target, of all its platforms for an index.
+	Layers int32 `json:"layers,omitempty"`
+
+	StartTime      *metav1.Time `json:"startTime,omitempty"`
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+
+	// FailedStage is the stage the image failed in: check, pull, push or copy.
+	FailedStage string `json:"failedStage,omitempty"`
+	// Output is the tail of the error of the failed stage.
+	Output string `json:"output,omitempty"`
+	// Referrers is the number of referrers and cosign artifacts copied with the image, when copyReferrers is set.
+	Referrers *int32 `json:"referrers,omitempty"`
 }
 
 //+kubebuilder:object:root=true
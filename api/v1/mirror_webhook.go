@@ -18,9 +18,15 @@ package v1
 
 import (
 	"context"
+	"fmt"
+	"github.com/Masterminds/semver/v3"
+	"github.com/yxwuxuanl/k8s-image-operator/internal/reference"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/validation/field"
+	"regexp"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
@@ -57,32 +63,238 @@ func (r *Mirror) ValidateCreate() (admission.Warnings, error) {
 
 // ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
 func (r *Mirror) ValidateUpdate(old runtime.Object) (admission.Warnings, error) {
+	oldMirror, ok := old.(*Mirror)
+	if !ok {
+		return nil, nil
+	}
+
+	// a Mirror runs its Job once, a changed spec would never be applied.
+	// Only how long it is kept can be changed, like the TTL of a Job.
+	oldSpec, newSpec := oldMirror.Spec.DeepCopy(), r.Spec.DeepCopy()
+	oldSpec.TTLSecondsAfterFinished, newSpec.TTLSecondsAfterFinished = nil, nil
+
+	if !equality.Semantic.DeepEqual(oldSpec, newSpec) {
+		return nil, field.Forbidden(
+			field.NewPath("spec"),
+			"the spec of a Mirror is immutable, create a new Mirror or use a MirrorSchedule to mirror images again",
+		)
+	}
+
 	return nil, nil
 }
 
 func (r *Mirror) validate() error {
-	if r.Spec.DockerConfig != nil {
-		secret := &corev1.Secret{}
-		path := field.NewPath("spec").Key("dockerConfig")
-
-		if err := kclient.Get(context.Background(), client.ObjectKey{
-			Namespace: r.Namespace,
-			Name:      r.Spec.DockerConfig.SecretName,
-		}, secret); err != nil {
-			return field.NotFound(
-				path,
-				r.Spec.DockerConfig.SecretName,
-			)
-		}
-
-		if secret.Type != corev1.SecretTypeDockerConfigJson {
-			return field.TypeInvalid(
-				path,
-				secret.Type,
-				string("Secret type must be "+corev1.SecretTypeDockerConfigJson),
-			)
+	if errs := validateMirrorSpec(field.NewPath("spec"), r.Namespace, &r.Spec); len(errs) > 0 {
+		return apierrors.NewInvalid(GroupVersion.WithKind("Mirror").GroupKind(), r.Name, errs)
+	}
+
+	return nil
+}
+
+// platformRegexp matches os/arch[/variant].
+var platformRegexp = regexp.MustCompile(`^[a-z0-9]+/[a-z0-9_]+(/[a-z0-9]+)?$`)
+
+// validateMirrorSpec validates the spec of a Mirror, or the template of a MirrorSchedule.
+func validateMirrorSpec(path *field.Path, namespace string, spec *MirrorSpec) field.ErrorList {
+	var allErrs field.ErrorList
+
+	if len(spec.Images) == 0 {
+		allErrs = append(allErrs, field.Required(path.Child("images"), "at least one image must be set"))
+	}
+
+	// pairs are the (source, target) pairs after the tags are expanded, normalized so that
+	// nginx and docker.io/library/nginx:latest are the same image
+	pairs := make(map[[2]string]bool)
+
+	for i, image := range spec.Images {
+		path := path.Child("images").Index(i)
+
+		source, err := reference.Parse(image.Source)
+		if err != nil {
+			allErrs = append(allErrs, field.Invalid(path.Child("source"), image.Source, err.Error()))
+		} else if (len(image.Tags) > 0 || image.TagSelector != nil) && (source.Tag != "" || source.Digest != "") {
+			allErrs = append(allErrs, field.Invalid(path.Child("source"), image.Source, "must not have a tag or digest when tags or tagSelector is set"))
+		}
+
+		var targets []reference.Reference
+
+		// the tags are pushed to the target, it can't have a tag of its own or a digest
+		validateTarget := func(path *field.Path, target string) {
+			ref, err := reference.Parse(target)
+			switch {
+			case err != nil:
+				allErrs = append(allErrs, field.Invalid(path, target, err.Error()))
+			case ref.Digest != "":
+				allErrs = append(allErrs, field.Invalid(path, target, "must not have a digest, the digest of a pushed image can't be chosen"))
+			case ref.Tag != "" && (len(image.Tags) > 0 || image.TagSelector != nil):
+				allErrs = append(allErrs, field.Invalid(path, target, "must not have a tag when tags or tagSelector is set"))
+			default:
+				targets = append(targets, ref)
+			}
+		}
+
+		if image.Target != "" {
+			validateTarget(path.Child("target"), image.Target)
+		}
+
+		for j, target := range image.Targets {
+			validateTarget(path.Child("targets").Index(j), target)
+		}
+
+		if len(image.AllTargets()) == 0 {
+			allErrs = append(allErrs, field.Required(path.Child("target"), "target or targets must be set"))
+		}
+
+		for j, tag := range image.Tags {
+			if err := reference.ValidateTag(tag); err != nil {
+				allErrs = append(allErrs, field.Invalid(path.Child("tags").Index(j), tag, err.Error()))
+			}
+		}
+
+		platforms := make(map[string]bool)
+		for j, platform := range image.Platforms {
+			if !platformRegexp.MatchString(platform) {
+				allErrs = append(allErrs, field.Invalid(path.Child("platforms").Index(j), platform, "must be os/arch or os/arch/variant, e.g. linux/arm64 or linux/arm/v7"))
+			} else if platforms[platform] {
+				allErrs = append(allErrs, field.Duplicate(path.Child("platforms").Index(j), platform))
+			}
+
+			platforms[platform] = true
+		}
+
+		// without preserveIndex a single platform image is mirrored
+		if len(image.Platforms) > 1 && !image.PreserveIndex {
+			allErrs = append(allErrs, field.Invalid(path.Child("platforms"), image.Platforms, "only one platform can be set when preserveIndex is not set"))
+		}
+
+		// the signatures and referrers are attached to the digest of the source, which the annotation changes
+		if image.CopyReferrers && spec.SetSourceAnnotation {
+			allErrs = append(allErrs, field.Invalid(path.Child("copyReferrers"), image.CopyReferrers, "must not be set with setSourceAnnotation, the artifacts of the source don't apply to the annotated target"))
+		}
+
+		if selector := image.TagSelector; selector != nil {
+			allErrs = append(allErrs, validateTagSelector(path.Child("tagSelector"), selector)...)
+		}
+
+		if err != nil || len(targets) < len(image.AllTargets()) {
+			continue
+		}
+
+		tags := image.Tags
+		if len(tags) == 0 {
+			tags = []string{""}
+		}
+
+		for _, tag := range tags {
+			for _, target := range targets {
+				pair := [2]string{normalizedImage(source, tag), normalizedImage(target, tag)}
+				if pairs[pair] {
+					allErrs = append(allErrs, field.Duplicate(path, pair[0]+" to "+pair[1]))
+					continue
+				}
+
+				pairs[pair] = true
+			}
+		}
+	}
+
+	if spec.Parallelism < 0 {
+		allErrs = append(allErrs, field.Invalid(path.Child("parallelism"), spec.Parallelism, "must be at least 1"))
+	} else if count, ok := spec.ImageCount(); ok && spec.Parallelism > count {
+		allErrs = append(allErrs, field.Invalid(
+			path.Child("parallelism"),
+			spec.Parallelism,
+			fmt.Sprintf("must not be greater than the number of images to mirror, %d", count),
+		))
+	}
+
+	for _, credentials := range []struct {
+		path        *field.Path
+		credentials []RegistryCredential
+	}{
+		{path.Child("sourceCredentials"), spec.SourceCredentials},
+		{path.Child("targetCredentials"), spec.TargetCredentials},
+	} {
+		for i, credential := range credentials.credentials {
+			path := credentials.path.Index(i)
+
+			for j, registry := range credential.Registries {
+				if err := reference.ValidateDomain(registry); err != nil {
+					allErrs = append(allErrs, field.Invalid(path.Child("registries").Index(j), registry, err.Error()))
+				}
+			}
+
+			if err := validateDockerConfig(path.Child("secretName"), namespace, credential.SecretName); err != nil {
+				allErrs = append(allErrs, err)
+			}
 		}
 	}
+
+	if spec.DockerConfig != nil {
+		if err := validateDockerConfig(path.Key("dockerConfig"), namespace, spec.DockerConfig.SecretName); err != nil {
+			allErrs = append(allErrs, err)
+		}
+	}
+
+	return allErrs
+}
+
+// normalizedImage returns ref with tag, as the container runtime names it.
+func normalizedImage(ref reference.Reference, tag string) string {
+	if tag != "" {
+		ref = ref.WithTag(tag)
+	}
+
+	if normalized, err := reference.ParseNormalized(ref.String()); err == nil {
+		ref = normalized
+	}
+
+	return ref.WithDefaultTag().String()
+}
+
+func validateTagSelector(path *field.Path, selector *TagSelector) field.ErrorList {
+	var allErrs field.ErrorList
+
+	if selector.Regex != "" {
+		if _, err := regexp.Compile(selector.Regex); err != nil {
+			allErrs = append(allErrs, field.Invalid(path.Child("regex"), selector.Regex, err.Error()))
+		}
+	}
+
+	if selector.SemverRange != "" {
+		if _, err := semver.NewConstraint(selector.SemverRange); err != nil {
+			allErrs = append(allErrs, field.Invalid(path.Child("semverRange"), selector.SemverRange, err.Error()))
+		}
+	}
+
+	for i, exclude := range selector.Exclude {
+		if _, err := regexp.Compile(exclude); err != nil {
+			allErrs = append(allErrs, field.Invalid(path.Child("exclude").Index(i), exclude, err.Error()))
+		}
+	}
+
+	return allErrs
+}
+
+// validateDockerConfig checks that the Secret exists and is a dockerconfigjson.
+func validateDockerConfig(path *field.Path, namespace, name string) *field.Error {
+	secret := &corev1.Secret{}
+
+	if err := kclient.Get(context.Background(), client.ObjectKey{
+		Namespace: namespace,
+		Name:      name,
+	}, secret); err != nil {
+		return field.NotFound(path, name)
+	}
+
+	if secret.Type != corev1.SecretTypeDockerConfigJson {
+		return field.TypeInvalid(
+			path,
+			secret.Type,
+			string("Secret type must be "+corev1.SecretTypeDockerConfigJson),
+		)
+	}
+
 	return nil
 }
 
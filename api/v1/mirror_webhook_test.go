@@ -0,0 +1,133 @@
+package v1
+
+import (
+	"errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/utils/ptr"
+	"testing"
+)
+
+func TestValidateMirrorSpecImages(t *testing.T) {
+	tests := []struct {
+		name                string
+		image               MirrorImage
+		setSourceAnnotation bool
+		field               string
+	}{
+		{
+			name:  "single image",
+			image: MirrorImage{Source: "nginx:1.25", Target: "myregistry/nginx:1.25"},
+		},
+		{
+			name:  "tags",
+			image: MirrorImage{Source: "nginx", Target: "myregistry/nginx", Tags: []string{"1.25"}},
+		},
+		{
+			name:  "target with a digest",
+			image: MirrorImage{Source: "nginx:1.25", Target: "myregistry/nginx@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"},
+			field: "spec.images[0].target",
+		},
+		{
+			name:  "target with a tag and tags",
+			image: MirrorImage{Source: "nginx", Target: "myregistry/nginx:1.25", Tags: []string{"1.25"}},
+			field: "spec.images[0].target",
+		},
+		{
+			name:  "targets with a tag and a tag selector",
+			image: MirrorImage{Source: "nginx", Targets: []string{"myregistry/nginx:stable"}, TagSelector: &TagSelector{Regex: `^1\.`}},
+			field: "spec.images[0].targets[0]",
+		},
+		{
+			name:  "single platform",
+			image: MirrorImage{Source: "nginx:1.25", Target: "myregistry/nginx:1.25", Platforms: []string{"linux/arm64"}},
+		},
+		{
+			name:  "platforms without preserveIndex",
+			image: MirrorImage{Source: "nginx:1.25", Target: "myregistry/nginx:1.25", Platforms: []string{"linux/amd64", "linux/arm64"}},
+			field: "spec.images[0].platforms",
+		},
+		{
+			name:  "platforms with preserveIndex",
+			image: MirrorImage{Source: "nginx:1.25", Target: "myregistry/nginx:1.25", Platforms: []string{"linux/amd64", "linux/arm64"}, PreserveIndex: true},
+		},
+		{
+			name:  "copyReferrers",
+			image: MirrorImage{Source: "nginx:1.25", Target: "myregistry/nginx:1.25", CopyReferrers: true},
+		},
+		{
+			name:                "copyReferrers with setSourceAnnotation",
+			image:               MirrorImage{Source: "nginx:1.25", Target: "myregistry/nginx:1.25", CopyReferrers: true},
+			setSourceAnnotation: true,
+			field:               "spec.images[0].copyReferrers",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := &MirrorSpec{Images: []MirrorImage{tt.image}, Parallelism: 1, SetSourceAnnotation: tt.setSourceAnnotation}
+
+			errs := validateMirrorSpec(field.NewPath("spec"), "default", spec)
+			if tt.field == "" {
+				if len(errs) > 0 {
+					t.Errorf("validateMirrorSpec() = %v, want no error", errs)
+				}
+				return
+			}
+
+			if len(errs) != 1 || errs[0].Field != tt.field || errs[0].Type != field.ErrorTypeInvalid {
+				t.Errorf("validateMirrorSpec() = %v, want an invalid %s", errs, tt.field)
+			}
+		})
+	}
+}
+
+func TestMirrorValidateUpdate(t *testing.T) {
+	old := &Mirror{
+		ObjectMeta: metav1.ObjectMeta{Name: "nginx", Namespace: "default"},
+		Spec: MirrorSpec{
+			Images:                  []MirrorImage{{Source: "nginx:1.25", Target: "myregistry/nginx:1.25"}},
+			TTLSecondsAfterFinished: ptr.To(int32(3600)),
+		},
+	}
+
+	tests := []struct {
+		name    string
+		update  func(mirror *Mirror)
+		wantErr bool
+	}{
+		{
+			name:    "spec",
+			update:  func(mirror *Mirror) { mirror.Spec.Images[0].Target = "myregistry/nginx:1.26" },
+			wantErr: true,
+		},
+		{
+			name:   "ttlSecondsAfterFinished",
+			update: func(mirror *Mirror) { mirror.Spec.TTLSecondsAfterFinished = ptr.To(int32(0)) },
+		},
+		{
+			name: "metadata",
+			update: func(mirror *Mirror) {
+				mirror.Labels = map[string]string{"team": "platform"}
+				mirror.Annotations = map[string]string{"image.lin2ur.cn/retry-failed": ""}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mirror := old.DeepCopy()
+			tt.update(mirror)
+
+			_, err := mirror.ValidateUpdate(old)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ValidateUpdate() error = %v, want error %v", err, tt.wantErr)
+			}
+
+			var fieldErr *field.Error
+			if tt.wantErr && (!errors.As(err, &fieldErr) || fieldErr.Type != field.ErrorTypeForbidden || fieldErr.Field != "spec") {
+				t.Errorf("ValidateUpdate() error = %v, want spec forbidden", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// MirrorScheduleSpec defines the desired state of MirrorSchedule
+type MirrorScheduleSpec struct {
+	// Schedule is a cron expression, e.g. "0 */6 * * *".
+	// +kubebuilder:validation:MinLength=1
+	Schedule string `json:"schedule"`
+
+	// StartingDeadlineSeconds is how late a missed run may still be started.
+	// +optional
+	StartingDeadlineSeconds *int64 `json:"startingDeadlineSeconds,omitempty"`
+
+	// ConcurrencyPolicy is what to do when a run is due while the Mirror of the previous run is still running:
+	// Allow runs them concurrently, Forbid skips the new run and Replace deletes the running Mirror.
+	// +kubebuilder:validation:Enum=Allow;Forbid;Replace
+	// +kubebuilder:default:=Forbid
+	ConcurrencyPolicy ConcurrencyPolicy `json:"concurrencyPolicy,omitempty"`
+
+	// Suspend stops creating Mirrors, the running ones are not affected.
+	Suspend bool `json:"suspend,omitempty"`
+
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:default:=3
+	SuccessfulHistoryLimit *int32 `json:"successfulHistoryLimit,omitempty"`
+
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:default:=1
+	FailedHistoryLimit *int32 `json:"failedHistoryLimit,omitempty"`
+
+	// Template is the spec of the Mirrors created on schedule.
+	Template MirrorSpec `json:"template"`
+}
+
+type ConcurrencyPolicy string
+
+const (
+	AllowConcurrent   ConcurrencyPolicy = "Allow"
+	ForbidConcurrent  ConcurrencyPolicy = "Forbid"
+	ReplaceConcurrent ConcurrencyPolicy = "Replace"
+)
+
+// MirrorScheduleStatus defines the observed state of MirrorSchedule
+type MirrorScheduleStatus struct {
+	// Active are the Mirrors that are still running.
+	Active []corev1.ObjectReference `json:"active,omitempty"`
+
+	LastScheduleTime   *metav1.Time `json:"lastScheduleTime,omitempty"`
+	LastSuccessfulTime *metav1.Time `json:"lastSuccessfulTime,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Schedule",type="string",JSONPath=".spec.schedule"
+//+kubebuilder:printcolumn:name="Suspend",type="boolean",JSONPath=".spec.suspend"
+//+kubebuilder:printcolumn:name="Active",type="number",JSONPath=".status.active.length"
+//+kubebuilder:printcolumn:name="Last Schedule",type="date",JSONPath=".status.lastScheduleTime"
+//+kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+
+// MirrorSchedule is the Schema for the mirrorschedules API
+type MirrorSchedule struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   MirrorScheduleSpec   `json:"spec,omitempty"`
+	Status MirrorScheduleStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// MirrorScheduleList contains a list of MirrorSchedule
+type MirrorScheduleList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []MirrorSchedule `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&MirrorSchedule{}, &MirrorScheduleList{})
+}
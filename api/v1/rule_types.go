@@ -17,6 +17,7 @@ limitations under the License.
 package v1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -37,23 +38,85 @@ type RuleSpec struct {
 
 	// +kubebuilder:default="Ignore"
 	FailurePolicy string `json:"failurePolicy,omitempty"`
+
+	// EnforcementAction is what happens when the rule matches a pod:
+	// enforce rewrites images and denies pods, warn returns the would-be changes as admission warnings,
+	// dryRun only logs them and records events.
+	// In warn and dryRun modes, pods are admitted unchanged and counted in podsWarned instead.
+	// +kubebuilder:validation:Enum=enforce;warn;dryRun
+	// +kubebuilder:default="enforce"
+	EnforcementAction EnforcementAction `json:"enforcementAction,omitempty"`
+
+	// PinDigest resolves the tag of the (rewritten) image to its manifest digest at admission time,
+	// so that every replica runs the same image even if the tag moves.
+	PinDigest bool `json:"pinDigest,omitempty"`
+
+	// DockerConfig references a kubernetes.io/dockerconfigjson Secret used to resolve digests.
+	DockerConfig *corev1.SecretReference `json:"dockerConfig,omitempty"`
+
+	// Policy restricts the registries of the final images, after rewriting.
+	Policy *RegistryPolicy `json:"policy,omitempty"`
 }
 
+type EnforcementAction string
+
+const (
+	EnforcementActionEnforce EnforcementAction = "enforce"
+	EnforcementActionWarn    EnforcementAction = "warn"
+	EnforcementActionDryRun  EnforcementAction = "dryRun"
+)
+
 type RewriteRule struct {
 	Registry    string `json:"registry,omitempty"`
 	Regex       string `json:"regex,omitempty"`
 	Replacement string `json:"replacement"`
 }
 
+type RegistryPolicy struct {
+	// AllowedRegistries denies the images whose registry matches none of the patterns, if set.
+	AllowedRegistries []RegistryPattern `json:"allowedRegistries,omitempty"`
+	// DeniedRegistries denies the images whose registry matches any of the patterns.
+	DeniedRegistries []RegistryPattern `json:"deniedRegistries,omitempty"`
+}
+
+// RegistryPattern matches the registry host of an image, including the port, e.g. registry.example.com:5000.
+type RegistryPattern struct {
+	// Glob is a shell pattern, e.g. *.example.com
+	Glob string `json:"glob,omitempty"`
+	// Regex must match the whole registry, it is anchored at both ends.
+	Regex string `json:"regex,omitempty"`
+}
+
 // RuleStatus defines the observed state of Rule
 type RuleStatus struct {
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
+
+	ObservedGeneration int64              `json:"observedGeneration,omitempty"`
+	Conditions         []metav1.Condition `json:"conditions,omitempty"`
+
+	// The counters below are accumulated by every replica and flushed periodically.
+
+	// +kubebuilder:default:=0
+	PodsMutated int64 `json:"podsMutated"`
+	// +kubebuilder:default:=0
+	ContainersRewritten int64 `json:"containersRewritten"`
+	// +kubebuilder:default:=0
+	PodsDenied int64 `json:"podsDenied"`
+	// PodsWarned counts the pods the rule would have mutated or denied in warn and dryRun modes.
+	// +kubebuilder:default:=0
+	PodsWarned int64 `json:"podsWarned"`
 }
 
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
 // +kubebuilder:resource:scope=Cluster
+// +kubebuilder:printcolumn:name="Registered",type="string",JSONPath=".status.conditions[?(@.type==\"Registered\")].status"
+// +kubebuilder:printcolumn:name="Mutated",type="number",JSONPath=".status.podsMutated"
+// +kubebuilder:printcolumn:name="Rewritten",type="number",JSONPath=".status.containersRewritten"
+// +kubebuilder:printcolumn:name="Denied",type="number",JSONPath=".status.podsDenied"
+// +kubebuilder:printcolumn:name="Warned",type="number",JSONPath=".status.podsWarned"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
 
 // Rule is the Schema for the rules API
 type Rule struct {
@@ -18,13 +18,16 @@ package v1
 
 import (
 	"errors"
+	"github.com/yxwuxuanl/k8s-image-operator/internal/reference"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/validation/field"
+	"path/filepath"
 	"regexp"
 	ctrl "sigs.k8s.io/controller-runtime"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	"strings"
 )
 
 // log is for logging in this package.
@@ -32,6 +35,8 @@ var rulelog = logf.Log.WithName("rule-resource")
 
 // SetupWebhookWithManager will setup the manager to manage the webhooks
 func (r *Rule) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	kclient = mgr.GetClient()
+
 	return ctrl.NewWebhookManagedBy(mgr).
 		For(r).
 		Complete()
@@ -58,11 +63,21 @@ func (r *Rule) ValidateCreate() (admission.Warnings, error) {
 }
 
 func (r *Rule) validate() error {
-	if len(r.Spec.Rewrite) == 0 && len(r.Spec.DisallowedTags) == 0 {
-		return errors.New("`rewrite` and `disallowedTags` cannot both be empty")
+	if len(r.Spec.Rewrite) == 0 && len(r.Spec.DisallowedTags) == 0 && !r.Spec.PinDigest && r.Spec.Policy == nil {
+		return errors.New("`rewrite` and `disallowedTags` cannot both be empty unless `pinDigest` or `policy` is set")
 	}
 
 	for i, rule := range r.Spec.Rewrite {
+		if rule.Registry != "" {
+			if err := validateRegistry(rule.Registry); err != nil {
+				return field.Invalid(
+					field.NewPath("spec").Child("rewrite").Index(i).Key("registry"),
+					rule.Registry,
+					err.Error(),
+				)
+			}
+		}
+
 		if rule.Regex != "" {
 			if _, err := regexp.Compile(rule.Regex); err != nil {
 				return field.Invalid(
@@ -74,6 +89,83 @@ func (r *Rule) validate() error {
 		}
 	}
 
+	if policy := r.Spec.Policy; policy != nil {
+		path := field.NewPath("spec").Child("policy")
+
+		if err := validateRegistryPatterns(path.Child("allowedRegistries"), policy.AllowedRegistries); err != nil {
+			return err
+		}
+
+		if err := validateRegistryPatterns(path.Child("deniedRegistries"), policy.DeniedRegistries); err != nil {
+			return err
+		}
+	}
+
+	if ref := r.Spec.DockerConfig; ref != nil {
+		path := field.NewPath("spec").Child("dockerConfig")
+
+		if ref.Namespace == "" {
+			return field.Required(path.Child("namespace"), "namespace of the Secret is required")
+		}
+
+		if err := validateDockerConfig(path, ref.Namespace, ref.Name); err != nil {
+			return err
+		}
+	}
+
+	for i, tag := range r.Spec.DisallowedTags {
+		if err := reference.ValidateTag(tag); err != nil {
+			return field.Invalid(
+				field.NewPath("spec").Child("disallowedTags").Index(i),
+				tag,
+				err.Error(),
+			)
+		}
+	}
+
+	return nil
+}
+
+func validateRegistryPatterns(path *field.Path, patterns []RegistryPattern) error {
+	for i, pattern := range patterns {
+		if (pattern.Glob == "") == (pattern.Regex == "") {
+			return field.Invalid(path.Index(i), pattern, "exactly one of `glob` and `regex` must be set")
+		}
+
+		if pattern.Glob != "" {
+			if _, err := filepath.Match(pattern.Glob, ""); err != nil {
+				return field.Invalid(path.Index(i).Child("glob"), pattern.Glob, err.Error())
+			}
+		}
+
+		if pattern.Regex != "" {
+			if _, err := regexp.Compile(pattern.Regex); err != nil {
+				return field.Invalid(path.Index(i).Child("regex"), pattern.Regex, err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateRegistry checks a registry prefix such as docker.io or docker.io/library.
+func validateRegistry(registry string) error {
+	domain, path, _ := strings.Cut(registry, "/")
+	if err := reference.ValidateDomain(domain); err != nil {
+		return err
+	}
+
+	if path != "" {
+		ref, err := reference.Parse(path)
+		if err != nil {
+			return err
+		}
+
+		if ref.Tag != "" || ref.Digest != "" {
+			return errors.New("registry must not contain a tag or digest")
+		}
+	}
+
 	return nil
 }
 
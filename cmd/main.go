@@ -35,6 +35,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
 	imagev1 "github.com/yxwuxuanl/k8s-image-operator/api/v1"
+	"github.com/yxwuxuanl/k8s-image-operator/internal/agent"
 	"github.com/yxwuxuanl/k8s-image-operator/internal/controller"
 	//+kubebuilder:scaffold:imports
 )
@@ -52,6 +53,11 @@ func init() {
 }
 
 func main() {
+	// the mirror pods run the same binary as the manager
+	if len(os.Args) > 1 && os.Args[1] == "mirror-agent" {
+		os.Exit(agent.Main(os.Args[2:]))
+	}
+
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
@@ -124,10 +130,12 @@ func main() {
 		os.Exit(1)
 	}
 
-	if err = (&controller.RuleReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
-	}).SetupWithManager(mgr); err != nil {
+	ruleReconciler := &controller.RuleReconciler{
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("rule-controller"),
+	}
+	if err = ruleReconciler.SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Rule")
 		os.Exit(1)
 	}
@@ -138,8 +146,9 @@ func main() {
 		}
 	}
 	if err = (&controller.MirrorReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("mirror-controller"),
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Mirror")
 		os.Exit(1)
@@ -150,6 +159,28 @@ func main() {
 			os.Exit(1)
 		}
 	}
+	if err = (&controller.MirrorScheduleReconciler{
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("mirrorschedule-controller"),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "MirrorSchedule")
+		os.Exit(1)
+	}
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		if err = (&imagev1.MirrorSchedule{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "MirrorSchedule")
+			os.Exit(1)
+		}
+	}
+	if err = (&controller.ImageInventoryReconciler{
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("imageinventory-controller"),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "ImageInventory")
+		os.Exit(1)
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -160,6 +191,10 @@ func main() {
 		setupLog.Error(err, "unable to set up ready check")
 		os.Exit(1)
 	}
+	if err := mgr.AddReadyzCheck("rules", ruleReconciler.ReadyzCheck); err != nil {
+		setupLog.Error(err, "unable to set up ready check")
+		os.Exit(1)
+	}
 
 	//go controller.StartWebhookServer()
 
@@ -0,0 +1,611 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/logs"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"io"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// SourceAnnotation is set on the targets to the source they were mirrored from.
+	SourceAnnotation = "mirror-source"
+
+	// OutputTailBytes bounds the output kept in a Failure, the kubelet limits termination messages to 4096 bytes.
+	OutputTailBytes = 2048
+
+	// ExitCodeFailed is the exit code of a stage that failed with a transient error, running it again may succeed.
+	ExitCodeFailed = 1
+	// ExitCodePermanent is the exit code of a stage that failed with an error retrying can't fix,
+	// such as a missing image or denied credentials.
+	ExitCodePermanent = 2
+)
+
+// retryBackoff is the backoff between the attempts of a registry operation, its steps are set by --retries.
+var retryBackoff = wait.Backoff{
+	Duration: 2 * time.Second,
+	Factor:   2,
+	Jitter:   0.1,
+}
+
+// Main runs the stage of a mirror pod named by the first argument, and returns the exit code of the container.
+func Main(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: mirror-agent check|pull|push|copy [flags]")
+		return ExitCodePermanent
+	}
+
+	stage := args[0]
+
+	fs := flag.NewFlagSet("mirror-agent "+stage, flag.ContinueOnError)
+	workList := fs.String("work-list", "/etc/mirror/"+WorkListKey, "path of the work list")
+	indexes := fs.String("indexes", "", "comma separated indexes of the work list run by the Job, by completion index, all of them when empty")
+	dataDir := fs.String("data-dir", "/data", "directory the pull stage saves the source to")
+	terminationLog := fs.String("termination-log", "/dev/termination-log", "path the result is written to")
+	sourceDockerConfig := fs.String("source-docker-config", os.Getenv("DOCKER_CONFIG"), "docker config directory of the source registry")
+	targetDockerConfig := fs.String("target-docker-config", os.Getenv("DOCKER_CONFIG"), "docker config directory of the target registries")
+	retries := fs.Int("retries", 3, "retries of a registry operation failing with a transient error")
+	verbose := fs.Bool("verbose", false, "log the registry requests")
+
+	opts := zap.Options{}
+	opts.BindFlags(fs)
+
+	if err := fs.Parse(args[1:]); err != nil {
+		return ExitCodePermanent
+	}
+
+	logger := zap.New(zap.UseFlagOptions(&opts)).WithValues("stage", stage)
+
+	logs.Warn.SetOutput(os.Stderr)
+	if *verbose {
+		logs.Progress.SetOutput(os.Stderr)
+		logs.Debug.SetOutput(os.Stderr)
+	}
+
+	a := &agent{
+		dataDir:        *dataDir,
+		sourceKeychain: dockerConfigKeychain(*sourceDockerConfig),
+		targetKeychain: dockerConfigKeychain(*targetDockerConfig),
+		retries:        *retries,
+		logger:         logger,
+	}
+
+	result := &Result{UpToDate: make(map[int]string)}
+
+	if err := a.load(*workList, *indexes); err != nil {
+		result.Failure = newFailure(-1, stage, err)
+	} else {
+		ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer cancel()
+
+		switch stage {
+		case StageCheck:
+			result.Failure = a.runCheck(ctx, result)
+		case StagePull:
+			result.Failure = a.runPull(ctx)
+		case StagePush:
+			result.Failure = a.runPush(ctx, result)
+		case StageCopy:
+			result.Failure = a.runCopy(ctx, result)
+		default:
+			result.Failure = newFailure(-1, stage, fmt.Errorf("unknown stage %q", stage))
+		}
+	}
+
+	if err := writeResult(*terminationLog, result); err != nil {
+		logger.Error(err, "unable to write result")
+	}
+
+	if failure := result.Failure; failure != nil {
+		logger.Error(errors.New(failure.Output), "mirror failed", "target", failure.Target, "transient", failure.Transient)
+
+		if failure.Transient {
+			return ExitCodeFailed
+		}
+
+		return ExitCodePermanent
+	}
+
+	return 0
+}
+
+// agent mirrors the image of the Job completion index of the pod.
+type agent struct {
+	image               Image
+	setSourceAnnotation bool
+
+	dataDir                        string
+	sourceKeychain, targetKeychain authn.Keychain
+	retries                        int
+	logger                         logr.Logger
+}
+
+// artifact is the image or index mirrored from the source.
+type artifact interface {
+	remote.Taggable
+	Digest() (v1.Hash, error)
+}
+
+func (a *agent) load(path, indexes string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var workList WorkList
+	if err := json.Unmarshal(data, &workList); err != nil {
+		return fmt.Errorf("failed to parse work list: %w", err)
+	}
+
+	index, err := strconv.Atoi(os.Getenv("JOB_COMPLETION_INDEX"))
+	if err != nil {
+		return fmt.Errorf("invalid JOB_COMPLETION_INDEX: %w", err)
+	}
+
+	// the Job of a retry only runs some of the images
+	if indexes != "" {
+		list := strings.Split(indexes, ",")
+		if index < 0 || index >= len(list) {
+			return fmt.Errorf("no index at completion index %d of %s", index, indexes)
+		}
+
+		if index, err = strconv.Atoi(list[index]); err != nil {
+			return fmt.Errorf("invalid indexes: %w", err)
+		}
+	}
+
+	if index < 0 || index >= len(workList.Images) {
+		return fmt.Errorf("no image at index %d of the work list", index)
+	}
+
+	a.image = workList.Images[index]
+	a.setSourceAnnotation = workList.SetSourceAnnotation
+	a.logger = a.logger.WithValues("source", a.image.Source)
+
+	return nil
+}
+
+// runCheck reads the digest of the source and the up to date targets into result,
+// and saves it for the pull and push stages.
+func (a *agent) runCheck(ctx context.Context, result *Result) *Failure {
+	if failure := a.check(ctx, StageCheck, result); failure != nil {
+		return failure
+	}
+
+	data, err := json.Marshal(result)
+	if err == nil {
+		err = os.WriteFile(a.checkPath(), data, 0o644)
+	}
+
+	if err != nil {
+		return newFailure(-1, StageCheck, err)
+	}
+
+	return nil
+}
+
+// runPull saves the source to the data directory, unless every target is up to date.
+func (a *agent) runPull(ctx context.Context) *Failure {
+	checked, err := a.loadCheck()
+	if err != nil {
+		return newFailure(-1, StagePull, err)
+	}
+
+	if len(checked.UpToDate) == len(a.image.Targets) {
+		a.logger.Info("every target is up to date")
+		return nil
+	}
+
+	if err := a.retry(ctx, "pull", func() error {
+		source, err := a.fetch(ctx)
+		if err != nil {
+			return err
+		}
+
+		// a retry starts from an empty layout, blobs already written are kept
+		path, err := layout.Write(a.imagePath(), empty.Index)
+		if err != nil {
+			return err
+		}
+
+		switch source := source.(type) {
+		case v1.ImageIndex:
+			return path.AppendIndex(source)
+		case v1.Image:
+			return path.AppendImage(source)
+		default:
+			return fmt.Errorf("unexpected artifact %T", source)
+		}
+	}); err != nil {
+		return newFailure(-1, StagePull, err)
+	}
+
+	return nil
+}
+
+// runPush pushes the source saved by the pull stage to the targets that are not up to date.
+func (a *agent) runPush(ctx context.Context, result *Result) *Failure {
+	checked, err := a.loadCheck()
+	if err != nil {
+		return newFailure(-1, StagePush, err)
+	}
+
+	upToDate := len(checked.UpToDate) == len(a.image.Targets)
+	if upToDate && !a.image.CopyReferrers {
+		return nil
+	}
+
+	// the pull doesn't save the source when every target is up to date
+	var source artifact
+	if !upToDate {
+		if source, err = a.saved(); err != nil {
+			return newFailure(-1, StagePush, err)
+		}
+	}
+
+	return a.pushTargets(ctx, StagePush, source, checked.UpToDate, result)
+}
+
+// runCopy checks the targets and streams the source to those that are not up to date.
+func (a *agent) runCopy(ctx context.Context, result *Result) *Failure {
+	if failure := a.check(ctx, StageCopy, result); failure != nil {
+		return failure
+	}
+
+	var source artifact
+	if len(result.UpToDate) < len(a.image.Targets) {
+		if err := a.retry(ctx, "fetch", func() (err error) {
+			source, err = a.fetch(ctx)
+			return err
+		}); err != nil {
+			return newFailure(-1, StageCopy, err)
+		}
+	} else if !a.image.CopyReferrers {
+		return nil
+	}
+
+	return a.pushTargets(ctx, StageCopy, source, result.UpToDate, result)
+}
+
+// check reads the digest of the source, and the targets that already have it when they can be skipped.
+// Its failures are reported as failures of stage, the stage running the check.
+func (a *agent) check(ctx context.Context, stage string, result *Result) *Failure {
+	var source artifact
+	if err := a.retry(ctx, "fetch", func() (err error) {
+		source, err = a.fetch(ctx)
+		return err
+	}); err != nil {
+		return newFailure(-1, stage, err)
+	}
+
+	digest, err := source.Digest()
+	if err != nil {
+		return newFailure(-1, stage, err)
+	}
+
+	result.SourceDigest = digest.String()
+
+	// the digests can't match once the source annotation is set on the target
+	if a.setSourceAnnotation {
+		return nil
+	}
+
+	for j, target := range a.image.Targets {
+		ref, err := name.ParseReference(target)
+		if err != nil {
+			return newFailure(j, stage, err)
+		}
+
+		// a target that can't be read is mirrored, the push reports why if it fails too
+		desc, err := remote.Head(ref, a.options(ctx, a.targetKeychain)...)
+		if err != nil {
+			a.logger.V(1).Info("unable to read target digest", "target", target, "error", err.Error())
+			continue
+		}
+
+		if desc.Digest == digest {
+			a.logger.Info("target is up to date", "target", target, "digest", digest.String())
+			result.UpToDate[j] = digest.String()
+		}
+	}
+
+	// the targets that are pushed are described by the push
+	if len(result.UpToDate) > 0 {
+		if err := describe(result, source); err != nil {
+			a.logger.Error(err, "unable to describe the source")
+		}
+	}
+
+	return nil
+}
+
+// pushTargets pushes source to the targets in order, skipping the up to date ones, and stops at the first failure.
+// source is nil when every target is up to date. What was pushed is described in result.
+func (a *agent) pushTargets(ctx context.Context, stage string, source artifact, upToDate map[int]string, result *Result) *Failure {
+	var (
+		pushed       artifact = source
+		pushedDigest v1.Hash
+	)
+
+	if source != nil {
+		if a.setSourceAnnotation {
+			pushed = mutate.Annotations(source, map[string]string{
+				SourceAnnotation: a.image.Source,
+			}).(artifact)
+		}
+
+		digest, err := pushed.Digest()
+		if err != nil {
+			return newFailure(-1, stage, err)
+		}
+
+		pushedDigest = digest
+	}
+
+	for j, target := range a.image.Targets {
+		ref, err := name.ParseReference(target)
+		if err != nil {
+			return newFailure(j, stage, err)
+		}
+
+		targetDigest := pushedDigest
+		if digest, ok := upToDate[j]; ok {
+			if targetDigest, err = v1.NewHash(digest); err != nil {
+				return newFailure(j, stage, err)
+			}
+		} else {
+			if err := a.retry(ctx, "push", func() error {
+				return remote.Push(ref, pushed, a.options(ctx, a.targetKeychain)...)
+			}); err != nil {
+				return newFailure(j, stage, err)
+			}
+
+			a.logger.Info("mirrored", "target", target)
+		}
+
+		if a.image.CopyReferrers && !a.setSourceAnnotation {
+			copied, err := a.copyReferrers(ctx, ref, targetDigest)
+			if err != nil {
+				return newFailure(j, stage, fmt.Errorf("failed to copy referrers: %w", err))
+			}
+
+			if result.Referrers == nil {
+				result.Referrers = make(map[int]int32)
+			}
+
+			result.Referrers[j] = copied
+			a.logger.Info("copied referrers", "target", target, "count", copied)
+		}
+	}
+
+	if source != nil {
+		if err := describe(result, pushed); err != nil {
+			a.logger.Error(err, "unable to describe the mirrored image")
+		}
+	}
+
+	return nil
+}
+
+// fetch returns the source to mirror: the image of a single platform, or the index filtered by the platforms.
+func (a *agent) fetch(ctx context.Context) (artifact, error) {
+	ref, err := name.ParseReference(a.image.Source)
+	if err != nil {
+		return nil, err
+	}
+
+	platforms, err := parsePlatforms(a.image.Platforms)
+	if err != nil {
+		return nil, err
+	}
+
+	options := a.options(ctx, a.sourceKeychain)
+
+	if !a.image.PreserveIndex {
+		// the webhook rejects this, a single platform image can't hold the others
+		if len(platforms) > 1 {
+			return nil, fmt.Errorf("preserveIndex must be set to mirror %d platforms", len(platforms))
+		}
+
+		if len(platforms) > 0 {
+			options = append(options, remote.WithPlatform(platforms[0]))
+		}
+
+		return remote.Image(ref, options...)
+	}
+
+	desc, err := remote.Get(ref, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	if !desc.MediaType.IsIndex() {
+		return desc.Image()
+	}
+
+	index, err := desc.ImageIndex()
+	if err != nil || len(platforms) == 0 {
+		return index, err
+	}
+
+	return filterIndex(index, platforms)
+}
+
+// saved returns the source saved to the data directory by the pull stage.
+func (a *agent) saved() (artifact, error) {
+	path, err := layout.FromPath(a.imagePath())
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := path.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(manifest.Manifests) != 1 {
+		return nil, fmt.Errorf("expected a single saved manifest, found %d", len(manifest.Manifests))
+	}
+
+	desc := manifest.Manifests[0]
+	if desc.MediaType.IsIndex() {
+		return index.ImageIndex(desc.Digest)
+	}
+
+	return index.Image(desc.Digest)
+}
+
+func (a *agent) loadCheck() (*Result, error) {
+	data, err := os.ReadFile(a.checkPath())
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{}
+	if err := json.Unmarshal(data, result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (a *agent) checkPath() string {
+	return filepath.Join(a.dataDir, "check.json")
+}
+
+func (a *agent) imagePath() string {
+	return filepath.Join(a.dataDir, "image")
+}
+
+func (a *agent) options(ctx context.Context, keychain authn.Keychain) []remote.Option {
+	return []remote.Option{
+		remote.WithContext(ctx),
+		remote.WithAuthFromKeychain(keychain),
+	}
+}
+
+// retry runs op until it succeeds, fails with an error that isn't transient or runs out of retries.
+func (a *agent) retry(ctx context.Context, op string, fn func() error) error {
+	backoff := retryBackoff
+	backoff.Steps = a.retries + 1
+
+	return retry.OnError(backoff, func(err error) bool {
+		if ctx.Err() != nil || !isTransient(err) {
+			return false
+		}
+
+		a.logger.Info("retrying", "op", op, "error", err.Error())
+		return true
+	}, fn)
+}
+
+// isTransient reports whether err may not happen again, such as a dropped connection or a rate limit.
+func isTransient(err error) bool {
+	var terr *transport.Error
+	if errors.As(err, &terr) {
+		return terr.StatusCode == http.StatusTooManyRequests || terr.Temporary()
+	}
+
+	var temporary interface{ Temporary() bool }
+	if errors.As(err, &temporary) && temporary.Temporary() {
+		return true
+	}
+
+	return errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+func parsePlatforms(platforms []string) ([]v1.Platform, error) {
+	var result []v1.Platform
+	for _, platform := range platforms {
+		p, err := v1.ParsePlatform(platform)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, *p)
+	}
+
+	return result, nil
+}
+
+// filterIndex returns index with only the manifests of platforms.
+func filterIndex(index v1.ImageIndex, platforms []v1.Platform) (v1.ImageIndex, error) {
+	matches := func(desc v1.Descriptor) bool {
+		if desc.Platform == nil {
+			return false
+		}
+
+		for _, platform := range platforms {
+			if desc.Platform.Satisfies(platform) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	filtered := mutate.RemoveManifests(index, func(desc v1.Descriptor) bool {
+		return !matches(desc)
+	})
+
+	manifest, err := filtered.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(manifest.Manifests) == 0 {
+		return nil, fmt.Errorf("no manifest in the index matches the platforms")
+	}
+
+	return filtered, nil
+}
+
+func newFailure(target int, stage string, err error) *Failure {
+	output := err.Error()
+	if len(output) > OutputTailBytes {
+		output = output[len(output)-OutputTailBytes:]
+	}
+
+	return &Failure{Target: target, Stage: stage, Output: output, Transient: isTransient(err)}
+}
+
+func writeResult(path string, result *Result) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0o644)
+}
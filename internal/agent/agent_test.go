@@ -0,0 +1,818 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// the retries of the tests don't wait
+	retryBackoff.Duration = time.Millisecond
+	os.Exit(m.Run())
+}
+
+// newTestRegistry starts an in-memory registry with the referrers API, behind wrap when it is not nil,
+// and returns its host.
+func newTestRegistry(t *testing.T, wrap func(http.Handler) http.Handler) string {
+	var handler http.Handler = registry.New(
+		registry.Logger(log.New(io.Discard, "", 0)),
+		registry.WithReferrersSupport(true),
+	)
+	if wrap != nil {
+		handler = wrap(handler)
+	}
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+// failManifests answers the manifest requests with status, and serves the others.
+func failManifests(status int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.Contains(r.URL.Path, "/manifests/") {
+				w.WriteHeader(status)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func parseReference(t *testing.T, ref string) name.Reference {
+	t.Helper()
+
+	nameRef, err := name.ParseReference(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return nameRef
+}
+
+// pushImage pushes a random image to ref and returns it.
+func pushImage(t *testing.T, ref string) v1.Image {
+	t.Helper()
+
+	image, err := random.Image(256, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := remote.Write(parseReference(t, ref), image); err != nil {
+		t.Fatal(err)
+	}
+
+	return image
+}
+
+// platformImage returns a random image whose config has platform.
+func platformImage(t *testing.T, platform v1.Platform) v1.Image {
+	t.Helper()
+
+	image, err := random.Image(256, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := image.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config = config.DeepCopy()
+	config.OS, config.Architecture, config.Variant = platform.OS, platform.Architecture, platform.Variant
+
+	if image, err = mutate.ConfigFile(image, config); err != nil {
+		t.Fatal(err)
+	}
+
+	return image
+}
+
+// platformIndex returns an index of an image per platform, listed with their platform.
+func platformIndex(t *testing.T, platforms ...string) v1.ImageIndex {
+	t.Helper()
+
+	var adds []mutate.IndexAddendum
+	for _, platform := range platforms {
+		p, err := v1.ParsePlatform(platform)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		adds = append(adds, mutate.IndexAddendum{
+			Add:        platformImage(t, *p),
+			Descriptor: v1.Descriptor{Platform: p},
+		})
+	}
+
+	return mutate.AppendManifests(empty.Index, adds...)
+}
+
+func pushIndex(t *testing.T, ref string, index v1.ImageIndex) {
+	t.Helper()
+
+	if err := remote.WriteIndex(parseReference(t, ref), index); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func digestOf(t *testing.T, artifact interface{ Digest() (v1.Hash, error) }) string {
+	t.Helper()
+
+	digest, err := artifact.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return digest.String()
+}
+
+// remoteDigest returns the digest of ref in its registry, or "" if it doesn't exist.
+func remoteDigest(t *testing.T, ref string) string {
+	t.Helper()
+
+	desc, err := remote.Head(parseReference(t, ref))
+	if err != nil {
+		return ""
+	}
+
+	return desc.Digest.String()
+}
+
+// runAgent runs stage on the first image of workList with dataDir, as the container of a mirror pod,
+// and returns its exit code and the result it wrote to the termination log.
+func runAgent(t *testing.T, stage string, workList WorkList, dataDir string) (int, *Result) {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	data, err := json.Marshal(workList)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	workListPath := filepath.Join(dir, WorkListKey)
+	if err := os.WriteFile(workListPath, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("JOB_COMPLETION_INDEX", "0")
+
+	terminationLog := filepath.Join(dir, "termination-log")
+	code := Main([]string{
+		stage,
+		"--work-list=" + workListPath,
+		"--data-dir=" + dataDir,
+		"--termination-log=" + terminationLog,
+		// an empty docker config directory is anonymous
+		"--source-docker-config=" + dir,
+		"--target-docker-config=" + dir,
+		"--retries=1",
+	})
+
+	data, err = os.ReadFile(terminationLog)
+	if err != nil {
+		t.Fatalf("read termination log: %s", err)
+	}
+
+	result := &Result{}
+	if err := json.Unmarshal(data, result); err != nil {
+		t.Fatalf("parse termination log %s: %s", data, err)
+	}
+
+	return code, result
+}
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "too many requests", err: &transport.Error{StatusCode: http.StatusTooManyRequests}, want: true},
+		{name: "service unavailable", err: &transport.Error{StatusCode: http.StatusServiceUnavailable}, want: true},
+		{name: "gateway timeout", err: &transport.Error{StatusCode: http.StatusGatewayTimeout}, want: true},
+		{name: "not found", err: &transport.Error{StatusCode: http.StatusNotFound}},
+		{name: "unauthorized", err: &transport.Error{StatusCode: http.StatusUnauthorized}},
+		{
+			name: "manifest unknown",
+			err:  &transport.Error{StatusCode: http.StatusNotFound, Errors: []transport.Diagnostic{{Code: transport.ManifestUnknownErrorCode}}},
+		},
+		{name: "wrapped status", err: fmt.Errorf("failed to push: %w", &transport.Error{StatusCode: http.StatusBadGateway}), want: true},
+		{name: "unexpected EOF", err: fmt.Errorf("read blob: %w", io.ErrUnexpectedEOF), want: true},
+		{name: "connection reset", err: &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, want: true},
+		{name: "connection refused", err: fmt.Errorf("dial: %w", syscall.ECONNREFUSED), want: true},
+		{name: "temporary DNS error", err: &net.DNSError{Err: "server misbehaving", IsTemporary: true}, want: true},
+		{name: "unknown host", err: &net.DNSError{Err: "no such host", IsNotFound: true}},
+		{name: "invalid reference", err: errors.New("could not parse reference")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isTransient(tt.err); got != tt.want {
+				t.Errorf("isTransient(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		name      string
+		errs      []error
+		wantCalls int
+		wantErr   bool
+	}{
+		{name: "success", errs: []error{nil}, wantCalls: 1},
+		{
+			name:      "transient error then success",
+			errs:      []error{&transport.Error{StatusCode: http.StatusServiceUnavailable}, nil},
+			wantCalls: 2,
+		},
+		{
+			name:      "permanent error is not retried",
+			errs:      []error{&transport.Error{StatusCode: http.StatusNotFound}, nil},
+			wantCalls: 1,
+			wantErr:   true,
+		},
+		{
+			name: "out of retries",
+			errs: []error{
+				&transport.Error{StatusCode: http.StatusTooManyRequests},
+				&transport.Error{StatusCode: http.StatusTooManyRequests},
+				&transport.Error{StatusCode: http.StatusTooManyRequests},
+				nil,
+			},
+			wantCalls: 3,
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &agent{retries: 2, logger: logr.Discard()}
+
+			var calls int
+			err := a.retry(context.Background(), "test", func() error {
+				calls++
+				return tt.errs[calls-1]
+			})
+
+			if calls != tt.wantCalls || (err != nil) != tt.wantErr {
+				t.Errorf("retry() = %v after %d calls, want %d calls and error %v", err, calls, tt.wantCalls, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRetryCanceled(t *testing.T) {
+	a := &agent{retries: 2, logger: logr.Discard()}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var calls int
+	_ = a.retry(ctx, "test", func() error {
+		calls++
+		return &transport.Error{StatusCode: http.StatusServiceUnavailable}
+	})
+
+	if calls != 1 {
+		t.Errorf("retry() called %d times once the context is canceled, want 1", calls)
+	}
+}
+
+func TestMainExitCode(t *testing.T) {
+	host := newTestRegistry(t, nil)
+	pushImage(t, host+"/app:v1")
+
+	rateLimited := newTestRegistry(t, failManifests(http.StatusTooManyRequests))
+
+	tests := []struct {
+		name          string
+		source        string
+		stage         string
+		wantCode      int
+		wantTransient bool
+	}{
+		{name: "mirrored", source: host + "/app:v1", stage: StageCopy},
+		{name: "missing image", source: host + "/app:missing", stage: StageCopy, wantCode: ExitCodePermanent},
+		{name: "rate limited registry", source: rateLimited + "/app:v1", stage: StageCopy, wantCode: ExitCodeFailed, wantTransient: true},
+		{name: "unknown stage", source: host + "/app:v1", stage: "mirror", wantCode: ExitCodePermanent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workList := WorkList{Images: []Image{{Source: tt.source, Targets: []string{host + "/mirror/app:v1"}}}}
+
+			code, result := runAgent(t, tt.stage, workList, t.TempDir())
+			if code != tt.wantCode {
+				t.Errorf("exit code = %d, want %d, result %+v", code, tt.wantCode, result.Failure)
+			}
+
+			if tt.wantCode == 0 {
+				if result.Failure != nil {
+					t.Errorf("failure = %+v, want none", result.Failure)
+				}
+				return
+			}
+
+			if failure := result.Failure; failure == nil || failure.Stage != tt.stage || failure.Target != -1 || failure.Transient != tt.wantTransient {
+				t.Errorf("failure = %+v, want stage %s of every target, transient %v", failure, tt.stage, tt.wantTransient)
+			}
+		})
+	}
+}
+
+func TestMainInvalidWorkList(t *testing.T) {
+	if code := Main(nil); code != ExitCodePermanent {
+		t.Errorf("Main() without a stage = %d, want %d", code, ExitCodePermanent)
+	}
+
+	workList := WorkList{Images: []Image{{Source: "nginx:1.25", Targets: []string{"myregistry/nginx:1.25"}}}}
+
+	dir := t.TempDir()
+	data, _ := json.Marshal(workList)
+	workListPath := filepath.Join(dir, WorkListKey)
+	if err := os.WriteFile(workListPath, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	terminationLog := filepath.Join(dir, "termination-log")
+
+	// the Job of a retry runs the indexes of the failed images, 3 isn't in the work list
+	t.Setenv("JOB_COMPLETION_INDEX", "0")
+	code := Main([]string{StageCopy, "--work-list=" + workListPath, "--termination-log=" + terminationLog, "--indexes=3"})
+	if code != ExitCodePermanent {
+		t.Errorf("exit code = %d, want %d", code, ExitCodePermanent)
+	}
+
+	data, err := os.ReadFile(terminationLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var result Result
+	if err := json.Unmarshal(data, &result); err != nil || result.Failure == nil || !strings.Contains(result.Failure.Output, "no image at index 3") {
+		t.Errorf("termination log = %s, want the failure of the index", data)
+	}
+}
+
+func TestNewFailureTail(t *testing.T) {
+	output := strings.Repeat("a", OutputTailBytes) + "the end"
+
+	failure := newFailure(1, StagePush, errors.New(output))
+	if len(failure.Output) != OutputTailBytes || !strings.HasSuffix(failure.Output, "the end") {
+		t.Errorf("newFailure() kept %d bytes ending with %q, want the last %d bytes", len(failure.Output), failure.Output[len(failure.Output)-7:], OutputTailBytes)
+	}
+
+	if failure.Target != 1 || failure.Stage != StagePush || failure.Transient {
+		t.Errorf("newFailure() = %+v, want a permanent failure of target 1 in %s", failure, StagePush)
+	}
+}
+
+func TestFilterIndex(t *testing.T) {
+	index := platformIndex(t, "linux/amd64", "linux/arm64", "linux/arm/v7")
+
+	tests := []struct {
+		name      string
+		platforms []string
+		want      []string
+		wantErr   bool
+	}{
+		{name: "single platform", platforms: []string{"linux/arm64"}, want: []string{"linux/arm64"}},
+		{name: "several platforms", platforms: []string{"linux/amd64", "linux/arm/v7"}, want: []string{"linux/amd64", "linux/arm/v7"}},
+		{name: "variant", platforms: []string{"linux/arm"}, want: []string{"linux/arm/v7"}},
+		{name: "no match", platforms: []string{"windows/amd64"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			platforms, err := parsePlatforms(tt.platforms)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			filtered, err := filterIndex(index, platforms)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("filterIndex() = %v, want an error", filtered)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("filterIndex() error = %v", err)
+			}
+
+			manifest, err := filtered.IndexManifest()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, desc := range manifest.Manifests {
+				got = append(got, desc.Platform.String())
+			}
+
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("filterIndex() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCopy(t *testing.T) {
+	host := newTestRegistry(t, nil)
+
+	image := pushImage(t, host+"/app:v1")
+	index := platformIndex(t, "linux/amd64", "linux/arm64")
+	pushIndex(t, host+"/app:multi", index)
+
+	tests := []struct {
+		name     string
+		image    Image
+		artifact interface{ Digest() (v1.Hash, error) }
+	}{
+		{
+			name:     "image",
+			image:    Image{Source: host + "/app:v1", Targets: []string{host + "/copy/app:v1"}},
+			artifact: image,
+		},
+		{
+			name:     "index",
+			image:    Image{Source: host + "/app:multi", Targets: []string{host + "/copy/app:multi"}, PreserveIndex: true},
+			artifact: index,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := digestOf(t, tt.artifact)
+
+			// copy streams the source to the target, nothing is saved to the data directory
+			dataDir := t.TempDir()
+
+			code, result := runAgent(t, StageCopy, WorkList{Images: []Image{tt.image}}, dataDir)
+			if code != 0 {
+				t.Fatalf("exit code = %d, failure %+v", code, result.Failure)
+			}
+
+			if got := remoteDigest(t, tt.image.Targets[0]); got != want {
+				t.Errorf("target digest = %s, want %s", got, want)
+			}
+
+			if result.SourceDigest != want || result.TargetDigest != want {
+				t.Errorf("result digests = %s, %s, want %s", result.SourceDigest, result.TargetDigest, want)
+			}
+
+			if entries, _ := os.ReadDir(dataDir); len(entries) > 0 {
+				t.Errorf("copy wrote %d entries to the data directory", len(entries))
+			}
+		})
+	}
+}
+
+func TestPullPush(t *testing.T) {
+	host := newTestRegistry(t, nil)
+	image := pushImage(t, host+"/app:v1")
+	want := digestOf(t, image)
+
+	workList := WorkList{Images: []Image{{Source: host + "/app:v1", Targets: []string{host + "/pull/app:v1"}}}}
+	dataDir := t.TempDir()
+
+	for _, stage := range []string{StageCheck, StagePull, StagePush} {
+		if code, result := runAgent(t, stage, workList, dataDir); code != 0 {
+			t.Fatalf("%s exit code = %d, failure %+v", stage, code, result.Failure)
+		}
+	}
+
+	if got := remoteDigest(t, host+"/pull/app:v1"); got != want {
+		t.Errorf("target digest = %s, want %s", got, want)
+	}
+}
+
+func TestCopyPlatforms(t *testing.T) {
+	host := newTestRegistry(t, nil)
+
+	index := platformIndex(t, "linux/amd64", "linux/arm64", "linux/arm/v7")
+	pushIndex(t, host+"/app:multi", index)
+
+	arm64, err := index.Image(platformDigest(t, index, "linux/arm64"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		image         Image
+		wantDigest    string
+		wantPlatforms []string
+		wantCode      int
+	}{
+		{
+			name:          "index as is",
+			image:         Image{Source: host + "/app:multi", PreserveIndex: true},
+			wantDigest:    digestOf(t, index),
+			wantPlatforms: []string{"linux/amd64", "linux/arm64", "linux/arm/v7"},
+		},
+		{
+			name:          "filtered index",
+			image:         Image{Source: host + "/app:multi", PreserveIndex: true, Platforms: []string{"linux/amd64", "linux/arm/v7"}},
+			wantPlatforms: []string{"linux/amd64", "linux/arm/v7"},
+		},
+		{
+			name:          "single platform",
+			image:         Image{Source: host + "/app:multi", Platforms: []string{"linux/arm64"}},
+			wantDigest:    digestOf(t, arm64),
+			wantPlatforms: []string{"linux/arm64"},
+		},
+		{
+			name:     "several platforms without preserveIndex",
+			image:    Image{Source: host + "/app:multi", Platforms: []string{"linux/amd64", "linux/arm64"}},
+			wantCode: ExitCodePermanent,
+		},
+		{
+			name:     "platform not in the index",
+			image:    Image{Source: host + "/app:multi", PreserveIndex: true, Platforms: []string{"windows/amd64"}},
+			wantCode: ExitCodePermanent,
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := fmt.Sprintf("%s/platforms/app:%d", host, i)
+			tt.image.Targets = []string{target}
+
+			code, result := runAgent(t, StageCopy, WorkList{Images: []Image{tt.image}}, t.TempDir())
+			if code != tt.wantCode {
+				t.Fatalf("exit code = %d, want %d, failure %+v", code, tt.wantCode, result.Failure)
+			}
+
+			if tt.wantCode != 0 {
+				if got := remoteDigest(t, target); got != "" {
+					t.Errorf("target was pushed with %s", got)
+				}
+				return
+			}
+
+			got := remoteDigest(t, target)
+			if got != result.TargetDigest || (tt.wantDigest != "" && got != tt.wantDigest) {
+				t.Errorf("target digest = %s, reported %s, want %s", got, result.TargetDigest, tt.wantDigest)
+			}
+
+			if strings.Join(result.Platforms, " ") != strings.Join(tt.wantPlatforms, " ") {
+				t.Errorf("platforms = %v, want %v", result.Platforms, tt.wantPlatforms)
+			}
+		})
+	}
+}
+
+// platformDigest returns the digest of the manifest of platform in index.
+func platformDigest(t *testing.T, index v1.ImageIndex, platform string) v1.Hash {
+	t.Helper()
+
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, desc := range manifest.Manifests {
+		if desc.Platform != nil && desc.Platform.String() == platform {
+			return desc.Digest
+		}
+	}
+
+	t.Fatalf("no manifest of %s in the index", platform)
+	return v1.Hash{}
+}
+
+// countManifestPuts counts the manifests pushed to the registry it wraps.
+func countManifestPuts(count *atomic.Int32) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/manifests/") {
+				count.Add(1)
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func TestCheckSkipsUpToDateTargets(t *testing.T) {
+	var puts atomic.Int32
+	host := newTestRegistry(t, countManifestPuts(&puts))
+
+	image := pushImage(t, host+"/app:v1")
+	want := digestOf(t, image)
+
+	t.Run("copy", func(t *testing.T) {
+		pushImage(t, host+"/copy/app:v1")
+		if err := remote.Write(parseReference(t, host+"/copy/app:up-to-date"), image); err != nil {
+			t.Fatal(err)
+		}
+		puts.Store(0)
+
+		workList := WorkList{Images: []Image{{
+			Source:  host + "/app:v1",
+			Targets: []string{host + "/copy/app:up-to-date", host + "/copy/app:v1"},
+		}}}
+
+		code, result := runAgent(t, StageCopy, workList, t.TempDir())
+		if code != 0 {
+			t.Fatalf("exit code = %d, failure %+v", code, result.Failure)
+		}
+
+		// only the outdated target is pushed
+		if n := puts.Load(); n != 1 {
+			t.Errorf("%d manifests pushed, want 1", n)
+		}
+
+		if len(result.UpToDate) != 1 || result.UpToDate[0] != want {
+			t.Errorf("up to date = %v, want target 0 at %s", result.UpToDate, want)
+		}
+
+		if result.SourceDigest != want || result.TargetDigest != want {
+			t.Errorf("result digests = %s, %s, want %s", result.SourceDigest, result.TargetDigest, want)
+		}
+
+		if got := remoteDigest(t, host+"/copy/app:v1"); got != want {
+			t.Errorf("outdated target digest = %s, want %s", got, want)
+		}
+	})
+
+	t.Run("pull and push", func(t *testing.T) {
+		if err := remote.Write(parseReference(t, host+"/pull/app:v1"), image); err != nil {
+			t.Fatal(err)
+		}
+		puts.Store(0)
+
+		workList := WorkList{Images: []Image{{Source: host + "/app:v1", Targets: []string{host + "/pull/app:v1"}}}}
+		dataDir := t.TempDir()
+
+		code, result := runAgent(t, StageCheck, workList, dataDir)
+		if code != 0 || result.UpToDate[0] != want || result.TargetDigest != want {
+			t.Fatalf("check = %d, %+v, want target 0 up to date at %s", code, result, want)
+		}
+
+		for _, stage := range []string{StagePull, StagePush} {
+			if code, result := runAgent(t, stage, workList, dataDir); code != 0 {
+				t.Fatalf("%s exit code = %d, failure %+v", stage, code, result.Failure)
+			}
+		}
+
+		if _, err := os.Stat(filepath.Join(dataDir, "image")); !os.IsNotExist(err) {
+			t.Errorf("the pull saved the source of an up to date target, stat error %v", err)
+		}
+
+		if n := puts.Load(); n != 0 {
+			t.Errorf("%d manifests pushed, want none", n)
+		}
+	})
+
+	t.Run("source annotation", func(t *testing.T) {
+		target := host + "/annotated/app:v1"
+		if err := remote.Write(parseReference(t, target), image); err != nil {
+			t.Fatal(err)
+		}
+
+		workList := WorkList{
+			Images:              []Image{{Source: host + "/app:v1", Targets: []string{target}}},
+			SetSourceAnnotation: true,
+		}
+
+		code, result := runAgent(t, StageCopy, workList, t.TempDir())
+		if code != 0 {
+			t.Fatalf("exit code = %d, failure %+v", code, result.Failure)
+		}
+
+		// the annotation changes the digest, so the target is never up to date
+		if len(result.UpToDate) > 0 || result.SourceDigest != want || result.TargetDigest == want {
+			t.Errorf("result = %+v, want the annotated target pushed", result)
+		}
+
+		if got := remoteDigest(t, target); got != result.TargetDigest {
+			t.Errorf("target digest = %s, want %s", got, result.TargetDigest)
+		}
+
+		pushed, err := remote.Image(parseReference(t, target))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		manifest, err := pushed.Manifest()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if source := manifest.Annotations[SourceAnnotation]; source != host+"/app:v1" {
+			t.Errorf("%s annotation = %q, want the source", SourceAnnotation, source)
+		}
+	})
+}
+
+// failManifestPuts answers the pushes of manifests with status, and serves the other requests.
+func failManifestPuts(status int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/manifests/") {
+				w.WriteHeader(status)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func TestCopyTargets(t *testing.T) {
+	host := newTestRegistry(t, nil)
+	image := pushImage(t, host+"/app:v1")
+	want := digestOf(t, image)
+
+	forbidden := newTestRegistry(t, failManifestPuts(http.StatusForbidden))
+	// the registry client retries 5xx itself, a rate limit is only retried by the agent
+	rateLimited := newTestRegistry(t, failManifestPuts(http.StatusTooManyRequests))
+
+	tests := []struct {
+		name          string
+		failing       string
+		wantCode      int
+		wantTransient bool
+	}{
+		{name: "every target"},
+		{name: "forbidden target", failing: forbidden, wantCode: ExitCodePermanent},
+		{name: "rate limited target", failing: rateLimited, wantCode: ExitCodeFailed, wantTransient: true},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			targets := []string{
+				fmt.Sprintf("%s/first/app:%d", host, i),
+				fmt.Sprintf("%s/second/app:%d", host, i),
+				fmt.Sprintf("%s/third/app:%d", host, i),
+			}
+			if tt.failing != "" {
+				targets[1] = tt.failing + "/app:v1"
+			}
+
+			workList := WorkList{Images: []Image{{Source: host + "/app:v1", Targets: targets}}}
+
+			code, result := runAgent(t, StageCopy, workList, t.TempDir())
+			if code != tt.wantCode {
+				t.Fatalf("exit code = %d, want %d, failure %+v", code, tt.wantCode, result.Failure)
+			}
+
+			if tt.failing == "" {
+				for _, target := range targets {
+					if got := remoteDigest(t, target); got != want {
+						t.Errorf("%s digest = %s, want %s", target, got, want)
+					}
+				}
+				return
+			}
+
+			// the failure names the target, the targets before it are pushed and the push stops there
+			if failure := result.Failure; failure == nil || failure.Target != 1 || failure.Stage != StageCopy || failure.Transient != tt.wantTransient {
+				t.Errorf("failure = %+v, want target 1 in %s, transient %v", failure, StageCopy, tt.wantTransient)
+			}
+
+			if got := remoteDigest(t, targets[0]); got != want {
+				t.Errorf("first target digest = %s, want %s", got, want)
+			}
+
+			if got := remoteDigest(t, targets[2]); got != "" {
+				t.Errorf("third target was pushed after the failure")
+			}
+		})
+	}
+}
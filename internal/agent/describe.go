@@ -0,0 +1,96 @@
+package agent
+
+import (
+	"fmt"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// describe records in result the digest, size, layers and platforms of the artifact pushed to the targets.
+// The platforms are the platforms of the manifests listed in the index, or the platform of the image.
+func describe(result *Result, pushed remote.Taggable) error {
+	switch pushed := pushed.(type) {
+	case v1.ImageIndex:
+		return describeIndex(result, pushed)
+	case v1.Image:
+		return describeImage(result, pushed)
+	default:
+		return fmt.Errorf("unexpected artifact %T", pushed)
+	}
+}
+
+func describeImage(result *Result, image v1.Image) error {
+	digest, err := image.Digest()
+	if err != nil {
+		return err
+	}
+
+	manifest, err := image.Manifest()
+	if err != nil {
+		return err
+	}
+
+	config, err := image.ConfigFile()
+	if err != nil {
+		return fmt.Errorf("failed to get config: %w", err)
+	}
+
+	result.TargetDigest = digest.String()
+	result.Size, result.Layers = manifestSize(manifest)
+	result.Platforms = nil
+
+	if platform := config.Platform(); platform != nil {
+		result.Platforms = []string{platform.String()}
+	}
+
+	return nil
+}
+
+func describeIndex(result *Result, index v1.ImageIndex) error {
+	digest, err := index.Digest()
+	if err != nil {
+		return err
+	}
+
+	indexManifest, err := index.IndexManifest()
+	if err != nil {
+		return err
+	}
+
+	result.TargetDigest = digest.String()
+	result.Size, result.Layers, result.Platforms = 0, 0, nil
+
+	for _, m := range indexManifest.Manifests {
+		// attestation manifests are listed with an unknown/unknown platform
+		if m.Platform == nil || m.Platform.OS == "unknown" || !m.MediaType.IsImage() {
+			continue
+		}
+
+		image, err := index.Image(m.Digest)
+		if err != nil {
+			return err
+		}
+
+		manifest, err := image.Manifest()
+		if err != nil {
+			return fmt.Errorf("failed to get manifest %s: %w", m.Digest, err)
+		}
+
+		size, layers := manifestSize(manifest)
+		result.Size += size
+		result.Layers += layers
+		result.Platforms = append(result.Platforms, m.Platform.String())
+	}
+
+	return nil
+}
+
+// manifestSize returns the compressed size of the config and layers of manifest, and its number of layers.
+func manifestSize(manifest *v1.Manifest) (int64, int32) {
+	size := manifest.Config.Size
+	for _, layer := range manifest.Layers {
+		size += layer.Size
+	}
+
+	return size, int32(len(manifest.Layers))
+}
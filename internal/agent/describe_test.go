@@ -0,0 +1,120 @@
+package agent
+
+import (
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"strings"
+	"testing"
+)
+
+// wantSize returns the size and layers describe reports for image.
+func wantSize(t *testing.T, image v1.Image) (int64, int32) {
+	t.Helper()
+
+	manifest, err := image.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size := manifest.Config.Size
+	for _, layer := range manifest.Layers {
+		size += layer.Size
+	}
+
+	return size, int32(len(manifest.Layers))
+}
+
+func TestDescribeImage(t *testing.T) {
+	image := platformImage(t, v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"})
+	size, layers := wantSize(t, image)
+
+	result := &Result{Platforms: []string{"stale"}}
+	if err := describe(result, image); err != nil {
+		t.Fatalf("describe() error = %v", err)
+	}
+
+	if result.TargetDigest != digestOf(t, image) || result.Size != size || result.Layers != layers {
+		t.Errorf("describe() = %s, %d bytes, %d layers, want %s, %d bytes, %d layers",
+			result.TargetDigest, result.Size, result.Layers, digestOf(t, image), size, layers)
+	}
+
+	if strings.Join(result.Platforms, " ") != "linux/arm/v7" {
+		t.Errorf("platforms = %v, want [linux/arm/v7]", result.Platforms)
+	}
+
+	// the config of an image built without a platform has none
+	image, err := random.Image(128, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := describe(result, image); err != nil {
+		t.Fatalf("describe() error = %v", err)
+	}
+
+	if _, layers := wantSize(t, image); result.Layers != layers || result.Platforms != nil {
+		t.Errorf("describe() = %d layers on %v, want %d layers and no platform", result.Layers, result.Platforms, layers)
+	}
+}
+
+func TestDescribeIndex(t *testing.T) {
+	index := platformIndex(t, "linux/amd64", "linux/arm64")
+
+	var (
+		size   int64
+		layers int32
+	)
+	for _, platform := range []string{"linux/amd64", "linux/arm64"} {
+		image, err := index.Image(platformDigest(t, index, platform))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s, l := wantSize(t, image)
+		size, layers = size+s, layers+l
+	}
+
+	// buildkit lists its attestations with an unknown/unknown platform, they aren't counted
+	attestation, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index = mutate.AppendManifests(index, mutate.IndexAddendum{
+		Add:        attestation,
+		Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "unknown", Architecture: "unknown"}},
+	})
+
+	result := &Result{}
+	if err := describe(result, index); err != nil {
+		t.Fatalf("describe() error = %v", err)
+	}
+
+	if result.TargetDigest != digestOf(t, index) || result.Size != size || result.Layers != layers {
+		t.Errorf("describe() = %s, %d bytes, %d layers, want %s, %d bytes, %d layers",
+			result.TargetDigest, result.Size, result.Layers, digestOf(t, index), size, layers)
+	}
+
+	if strings.Join(result.Platforms, " ") != "linux/amd64 linux/arm64" {
+		t.Errorf("platforms = %v, want [linux/amd64 linux/arm64]", result.Platforms)
+	}
+}
+
+func TestDescribePushed(t *testing.T) {
+	host := newTestRegistry(t, nil)
+	image := pushImage(t, host+"/app:v1")
+	size, layers := wantSize(t, image)
+
+	workList := WorkList{Images: []Image{{Source: host + "/app:v1", Targets: []string{host + "/mirror/app:v1"}}}}
+
+	code, result := runAgent(t, StageCopy, workList, t.TempDir())
+	if code != 0 {
+		t.Fatalf("exit code = %d, failure %+v", code, result.Failure)
+	}
+
+	if result.TargetDigest != digestOf(t, image) || result.Size != size || result.Layers != layers {
+		t.Errorf("result = %s, %d bytes, %d layers, want %s, %d bytes, %d layers",
+			result.TargetDigest, result.Size, result.Layers, digestOf(t, image), size, layers)
+	}
+}
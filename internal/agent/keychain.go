@@ -0,0 +1,54 @@
+package agent
+
+import (
+	"github.com/docker/cli/cli/config"
+	"github.com/docker/cli/cli/config/types"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"os"
+	"path/filepath"
+)
+
+// dockerConfigKeychain resolves the auths of the config.json of a docker config directory,
+// so a container can hold the credentials of the source and of the targets apart.
+type dockerConfigKeychain string
+
+func (dir dockerConfigKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	if _, err := os.Stat(filepath.Join(string(dir), config.ConfigFileName)); err != nil {
+		return authn.Anonymous, nil
+	}
+
+	cf, err := config.Load(string(dir))
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg, empty types.AuthConfig
+	for _, key := range []string{target.String(), target.RegistryStr()} {
+		if key == name.DefaultRegistry {
+			key = authn.DefaultAuthKey
+		}
+
+		if cfg, err = cf.GetAuthConfig(key); err != nil {
+			return nil, err
+		}
+
+		// GetAuthConfig sets the address, which isn't part of the credentials
+		cfg.ServerAddress = ""
+		if cfg != empty {
+			break
+		}
+	}
+
+	if cfg == empty {
+		return authn.Anonymous, nil
+	}
+
+	return authn.FromConfig(authn.AuthConfig{
+		Username:      cfg.Username,
+		Password:      cfg.Password,
+		Auth:          cfg.Auth,
+		IdentityToken: cfg.IdentityToken,
+		RegistryToken: cfg.RegistryToken,
+	}), nil
+}
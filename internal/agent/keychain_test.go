@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"encoding/base64"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDockerConfigKeychain(t *testing.T) {
+	dir := t.TempDir()
+
+	auth := func(username, password string) string {
+		return base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+	}
+
+	config := `{"auths": {
+		"registry.example.com": {"auth": "` + auth("registry", "secret") + `"},
+		"registry.example.com:5000": {"auth": "` + auth("port", "secret") + `"},
+		"https://index.docker.io/v1/": {"auth": "` + auth("hub", "secret") + `"}
+	}}`
+
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		keychain dockerConfigKeychain
+		ref      string
+		want     string
+	}{
+		{name: "registry", keychain: dockerConfigKeychain(dir), ref: "registry.example.com/team/app:v1", want: "registry"},
+		{name: "registry with a port", keychain: dockerConfigKeychain(dir), ref: "registry.example.com:5000/app:v1", want: "port"},
+		{name: "docker hub", keychain: dockerConfigKeychain(dir), ref: "nginx:1.25", want: "hub"},
+		{name: "other registry", keychain: dockerConfigKeychain(dir), ref: "quay.io/prometheus/node-exporter:v1.7.0"},
+		{name: "subdomain", keychain: dockerConfigKeychain(dir), ref: "mirror.registry.example.com/app:v1"},
+		{name: "no config", keychain: dockerConfigKeychain(t.TempDir()), ref: "registry.example.com/app:v1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ref, err := name.ParseReference(tt.ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			authenticator, err := tt.keychain.Resolve(ref.Context())
+			if err != nil {
+				t.Fatalf("Resolve() error = %v", err)
+			}
+
+			if tt.want == "" {
+				if authenticator != authn.Anonymous {
+					t.Errorf("Resolve(%s) = %v, want anonymous", tt.ref, authenticator)
+				}
+				return
+			}
+
+			config, err := authenticator.Authorization()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if config.Username != tt.want && config.Auth != auth(tt.want, "secret") {
+				t.Errorf("Resolve(%s) = %+v, want the credentials of %s", tt.ref, config, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"net/http"
+	"strings"
+)
+
+// cosignTagSuffixes are the suffixes of the tags cosign attaches to sha256-<digest>.
+var cosignTagSuffixes = []string{".sig", ".att", ".sbom"}
+
+// copyReferrers copies the artifacts attached to the source to the repository of target, and returns how many were copied.
+// The artifacts of both the digest of the source tag and of targetDigest are looked up, since a single platform mirror
+// of an index has the digest of one of its manifests.
+func (a *agent) copyReferrers(ctx context.Context, target name.Reference, targetDigest v1.Hash) (int32, error) {
+	sourceRef, err := name.ParseReference(a.image.Source)
+	if err != nil {
+		return 0, err
+	}
+
+	sourceOptions := a.options(ctx, a.sourceKeychain)
+	targetOptions := a.options(ctx, a.targetKeychain)
+
+	var sourceDesc *v1.Descriptor
+	if err := a.retry(ctx, "head", func() (err error) {
+		sourceDesc, err = remote.Head(sourceRef, sourceOptions...)
+		return err
+	}); err != nil {
+		return 0, fmt.Errorf("failed to resolve digest of %s: %w", sourceRef, err)
+	}
+
+	digests := []v1.Hash{sourceDesc.Digest}
+	if targetDigest != sourceDesc.Digest {
+		digests = append(digests, targetDigest)
+	}
+
+	sourceRepo, targetRepo := sourceRef.Context(), target.Context()
+
+	// copyIfExists copies a manifest if it exists, retrying transient errors
+	copyIfExists := func(source, target name.Reference) (bool, error) {
+		var ok bool
+		err := a.retry(ctx, "copy referrer", func() (err error) {
+			ok, err = copyManifest(source, target, sourceOptions, targetOptions)
+			return err
+		})
+		return ok, err
+	}
+
+	var copied int32
+	for _, digest := range digests {
+		for _, suffix := range cosignTagSuffixes {
+			tag := strings.Replace(digest.String(), ":", "-", 1) + suffix
+
+			ok, err := copyIfExists(sourceRepo.Tag(tag), targetRepo.Tag(tag))
+			if err != nil {
+				return copied, err
+			}
+
+			if ok {
+				copied++
+			}
+		}
+
+		var index v1.ImageIndex
+		if err := a.retry(ctx, "list referrers", func() (err error) {
+			index, err = remote.Referrers(sourceRepo.Digest(digest.String()), sourceOptions...)
+			return err
+		}); err != nil {
+			return copied, fmt.Errorf("failed to list referrers of %s@%s: %w", sourceRepo, digest, err)
+		}
+
+		manifest, err := index.IndexManifest()
+		if err != nil {
+			return copied, err
+		}
+
+		for _, referrer := range manifest.Manifests {
+			// the registry adds the copied manifest to the referrers of its subject in the target
+			ok, err := copyIfExists(sourceRepo.Digest(referrer.Digest.String()), targetRepo.Digest(referrer.Digest.String()))
+			if err != nil {
+				return copied, err
+			}
+
+			if ok {
+				copied++
+			}
+		}
+	}
+
+	return copied, nil
+}
+
+// copyManifest copies the image or index of source to target with its blobs.
+// It returns false when source doesn't exist.
+func copyManifest(source, target name.Reference, sourceOptions, targetOptions []remote.Option) (bool, error) {
+	desc, err := remote.Get(source, sourceOptions...)
+	if err != nil {
+		var terr *transport.Error
+		if errors.As(err, &terr) && terr.StatusCode == http.StatusNotFound {
+			return false, nil
+		}
+
+		return false, fmt.Errorf("failed to get %s: %w", source, err)
+	}
+
+	if desc.MediaType.IsIndex() {
+		err = copyIndex(desc, target, targetOptions)
+	} else {
+		err = copyImage(desc, target, targetOptions)
+	}
+
+	if err != nil {
+		return false, fmt.Errorf("failed to copy %s to %s: %w", source, target, err)
+	}
+
+	return true, nil
+}
+
+func copyIndex(desc *remote.Descriptor, target name.Reference, options []remote.Option) error {
+	index, err := desc.ImageIndex()
+	if err != nil {
+		return err
+	}
+
+	return remote.WriteIndex(target, index, options...)
+}
+
+func copyImage(desc *remote.Descriptor, target name.Reference, options []remote.Option) error {
+	image, err := desc.Image()
+	if err != nil {
+		return err
+	}
+
+	return remote.Write(target, image, options...)
+}
@@ -0,0 +1,185 @@
+package agent
+
+import (
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"strings"
+	"testing"
+)
+
+// attach pushes a cosign signature tag and an OCI referrer for the manifest digest in repository.
+func attach(t *testing.T, repository string, subject v1.Hash) {
+	t.Helper()
+
+	pushImage(t, repository+":"+cosignTag(subject, ".sig"))
+
+	referrer, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	referrer = mutate.Subject(referrer, v1.Descriptor{MediaType: types.OCIManifestSchema1, Digest: subject, Size: 1}).(v1.Image)
+
+	desc, err := partial.Descriptor(referrer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := remote.Write(parseReference(t, repository+"@"+desc.Digest.String()), referrer); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func cosignTag(digest v1.Hash, suffix string) string {
+	return strings.Replace(digest.String(), ":", "-", 1) + suffix
+}
+
+// referrersOf returns the number of referrers of repository@digest.
+func referrersOf(t *testing.T, repository string, digest v1.Hash) int {
+	t.Helper()
+
+	index, err := remote.Referrers(parseReference(t, repository+"@"+digest.String()).(name.Digest))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return len(manifest.Manifests)
+}
+
+func TestCopyReferrers(t *testing.T) {
+	host := newTestRegistry(t, nil)
+
+	image := pushImage(t, host+"/app:v1")
+	digest, err := image.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	attach(t, host+"/app", digest)
+
+	index := platformIndex(t, "linux/amd64", "linux/arm64")
+	pushIndex(t, host+"/app:multi", index)
+
+	// a platform image is signed on its own digest
+	arm64 := platformDigest(t, index, "linux/arm64")
+	attach(t, host+"/app", arm64)
+
+	tests := []struct {
+		name                string
+		image               Image
+		setSourceAnnotation bool
+		upToDate            bool
+		digest              v1.Hash
+		want                int32
+	}{
+		{
+			name:   "image",
+			image:  Image{Source: host + "/app:v1"},
+			digest: digest,
+			want:   2,
+		},
+		{
+			name:     "up to date target",
+			image:    Image{Source: host + "/app:v1"},
+			upToDate: true,
+			digest:   digest,
+			want:     2,
+		},
+		{
+			name:   "platform of an index",
+			image:  Image{Source: host + "/app:multi", Platforms: []string{"linux/arm64"}},
+			digest: arm64,
+			want:   2,
+		},
+		{
+			name:                "source annotation",
+			image:               Image{Source: host + "/app:v1"},
+			setSourceAnnotation: true,
+			digest:              digest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repository := host + "/" + strings.ReplaceAll(tt.name, " ", "-")
+			tt.image.Targets = []string{repository + ":v1"}
+			tt.image.CopyReferrers = true
+
+			// signatures may be added after the image was mirrored
+			if tt.upToDate {
+				if err := remote.Write(parseReference(t, tt.image.Targets[0]), image); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			workList := WorkList{Images: []Image{tt.image}, SetSourceAnnotation: tt.setSourceAnnotation}
+
+			code, result := runAgent(t, StageCopy, workList, t.TempDir())
+			if code != 0 {
+				t.Fatalf("exit code = %d, failure %+v", code, result.Failure)
+			}
+
+			if tt.upToDate && len(result.UpToDate) != 1 {
+				t.Errorf("up to date = %v, want the target skipped", result.UpToDate)
+			}
+
+			if got := result.Referrers[0]; got != tt.want {
+				t.Errorf("referrers = %d, want %d", got, tt.want)
+			}
+
+			// cosign finds the signature by the tag of the digest of the target
+			gotSignature := remoteDigest(t, repository+":"+cosignTag(tt.digest, ".sig")) != ""
+			if gotSignature != (tt.want > 0) {
+				t.Errorf("signature copied = %v, want %v", gotSignature, tt.want > 0)
+			}
+
+			if got := referrersOf(t, repository, tt.digest); got != int(tt.want)/2 {
+				t.Errorf("target has %d referrers, want %d", got, tt.want/2)
+			}
+		})
+	}
+}
+
+func TestPushReferrers(t *testing.T) {
+	host := newTestRegistry(t, nil)
+
+	image := pushImage(t, host+"/app:v1")
+	digest, err := image.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	attach(t, host+"/app", digest)
+
+	workList := WorkList{Images: []Image{{
+		Source:        host + "/app:v1",
+		Targets:       []string{host + "/pull/app:v1"},
+		CopyReferrers: true,
+	}}}
+	dataDir := t.TempDir()
+
+	var result *Result
+	for _, stage := range []string{StageCheck, StagePull, StagePush} {
+		var code int
+		if code, result = runAgent(t, stage, workList, dataDir); code != 0 {
+			t.Fatalf("%s exit code = %d, failure %+v", stage, code, result.Failure)
+		}
+	}
+
+	// the push stage copies the referrers once the target is pushed
+	if got := result.Referrers[0]; got != 2 {
+		t.Errorf("referrers = %d, want 2", got)
+	}
+
+	if remoteDigest(t, host+"/pull/app:"+cosignTag(digest, ".sig")) == "" {
+		t.Errorf("signature was not copied")
+	}
+}
@@ -0,0 +1,72 @@
+package agent
+
+// WorkListKey is the key of the work list in the ConfigMap mounted by the mirror pods.
+const WorkListKey = "work.json"
+
+// stages of a mirror pod, each one runs in its own container.
+const (
+	// StageCheck reads the digest of the source and finds the targets that are up to date.
+	StageCheck = "check"
+	// StagePull saves the source to the data directory.
+	StagePull = "pull"
+	// StagePush pushes the saved source to the targets.
+	StagePush = "push"
+	// StageCopy streams the source to the targets, checking them first.
+	StageCopy = "copy"
+)
+
+// WorkList is what the mirror pods of a Mirror copy, indexed by the completion index of the Job.
+type WorkList struct {
+	Images []Image `json:"images"`
+
+	// SetSourceAnnotation sets the mirror-source annotation on the targets, their digests
+	// can't match the source then, so they are never skipped.
+	SetSourceAnnotation bool `json:"setSourceAnnotation,omitempty"`
+}
+
+// Image is the source copied by a pod to every target.
+type Image struct {
+	Source    string   `json:"source"`
+	Targets   []string `json:"targets"`
+	Platforms []string `json:"platforms,omitempty"`
+
+	// PreserveIndex copies the index of the source, keeping only platforms when set,
+	// instead of the image of a single platform.
+	PreserveIndex bool `json:"preserveIndex,omitempty"`
+
+	// CopyReferrers copies the referrers and cosign artifacts of the source to every target,
+	// up to date targets included, since signatures may be added after the image.
+	// It is ignored with SetSourceAnnotation, the artifacts are attached to a digest the targets don't have.
+	CopyReferrers bool `json:"copyReferrers,omitempty"`
+}
+
+// Result is the result of a container of a mirror pod, written as JSON to its termination message.
+type Result struct {
+	SourceDigest string `json:"sourceDigest,omitempty"`
+	// UpToDate are the digests of the skipped targets, by index of the target.
+	UpToDate map[int]string `json:"upToDate,omitempty"`
+
+	// TargetDigest is the digest of what the targets have, which differs from the source digest
+	// when the source annotation is set.
+	TargetDigest string `json:"targetDigest,omitempty"`
+	// Size is the compressed size of the layers and configs of the target.
+	Size      int64    `json:"size,omitempty"`
+	Layers    int32    `json:"layers,omitempty"`
+	Platforms []string `json:"platforms,omitempty"`
+
+	// Referrers is the number of referrers and cosign artifacts copied, by index of the target.
+	Referrers map[int]int32 `json:"referrers,omitempty"`
+
+	Failure *Failure `json:"failure,omitempty"`
+}
+
+// Failure is the stage that failed and its error.
+type Failure struct {
+	// Target is the index of the target that failed, -1 when the stage failed for all of them.
+	Target int    `json:"target"`
+	Stage  string `json:"stage"`
+	Output string `json:"output,omitempty"`
+
+	// Transient is set when the error may not happen again, the pod can be retried.
+	Transient bool `json:"transient,omitempty"`
+}
@@ -0,0 +1,106 @@
+package controller
+
+import (
+	"context"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	imagev1 "github.com/yxwuxuanl/k8s-image-operator/api/v1"
+)
+
+// mirrorCleanerResync bounds the wait of the cleaner, so that Mirrors finishing in the meantime are noticed.
+const mirrorCleanerResync = time.Minute
+
+// mirrorCleaner deletes the Mirrors whose TTL after they finished expired. It only runs on the leader,
+// and waits for the next deadline between passes.
+type mirrorCleaner struct {
+	client.Client
+	Recorder record.EventRecorder
+}
+
+var _ manager.LeaderElectionRunnable = &mirrorCleaner{}
+
+func (c *mirrorCleaner) NeedLeaderElection() bool {
+	return true
+}
+
+func (c *mirrorCleaner) Start(ctx context.Context) error {
+	ctx = log.IntoContext(ctx, log.Log.WithName("mirror-cleaner"))
+
+	for {
+		wait := mirrorCleanerResync
+
+		next, err := c.clean(ctx)
+		if err != nil {
+			log.FromContext(ctx).Error(err, "unable to clean finished mirrors")
+		} else if !next.IsZero() {
+			wait = min(wait, max(time.Until(next), time.Second))
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(wait):
+		}
+	}
+}
+
+// clean deletes the expired Mirrors, and returns the next time a Mirror expires.
+func (c *mirrorCleaner) clean(ctx context.Context) (time.Time, error) {
+	var mirrors imagev1.MirrorList
+	if err := c.List(ctx, &mirrors); err != nil {
+		return time.Time{}, err
+	}
+
+	var next time.Time
+	for i := range mirrors.Items {
+		mirror := &mirrors.Items[i]
+
+		// the Mirrors of a MirrorSchedule or an ImageInventory are cleaned up by them, whatever their TTL
+		if mirrorOwner(mirror) != "" {
+			continue
+		}
+
+		ttl := mirrorTTL(mirror)
+		if ttl == 0 {
+			continue
+		}
+
+		finishedType, finishedAt := mirrorFinished(mirror)
+		if finishedType == "" {
+			continue
+		}
+
+		if expiresAt := finishedAt.Add(ttl); time.Now().Before(expiresAt) {
+			if next.IsZero() || expiresAt.Before(next) {
+				next = expiresAt
+			}
+			continue
+		}
+
+		c.Recorder.Eventf(mirror, corev1.EventTypeNormal, "CleanedUp", "Deleting Mirror finished more than %s ago", ttl)
+
+		if err := c.Delete(ctx, mirror); client.IgnoreNotFound(err) != nil {
+			log.FromContext(ctx).Error(err, "unable to delete mirror", "mirror", client.ObjectKeyFromObject(mirror).String())
+			continue
+		}
+
+		log.FromContext(ctx).Info("mirror deleted", "mirror", client.ObjectKeyFromObject(mirror).String())
+	}
+
+	return next, nil
+}
+
+// mirrorTTL returns how long mirror is kept after it finished, 0 keeps it forever.
+func mirrorTTL(mirror *imagev1.Mirror) time.Duration {
+	if ttl := mirror.Spec.TTLSecondsAfterFinished; ttl != nil {
+		return time.Duration(*ttl) * time.Second
+	}
+
+	return *cleanFinishedMirrorDuration
+}
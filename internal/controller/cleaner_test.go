@@ -0,0 +1,101 @@
+package controller
+
+import (
+	"context"
+	imagev1 "github.com/yxwuxuanl/k8s-image-operator/api/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestMirrorCleanerClean(t *testing.T) {
+	defaultTTL := *cleanFinishedMirrorDuration
+	*cleanFinishedMirrorDuration = 10 * time.Minute
+	t.Cleanup(func() { *cleanFinishedMirrorDuration = defaultTTL })
+
+	now := time.Now()
+
+	// finishedMirror returns a Mirror that finished ago, or is still running when ago is 0
+	finishedMirror := func(name string, ago time.Duration, ttl *int32) *imagev1.Mirror {
+		mirror := &imagev1.Mirror{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec:       imagev1.MirrorSpec{TTLSecondsAfterFinished: ttl},
+		}
+
+		if ago > 0 {
+			mirror.Status.Conditions = []metav1.Condition{{
+				Type:               "JobComplete",
+				Status:             metav1.ConditionTrue,
+				Reason:             "JobComplete",
+				LastTransitionTime: metav1.NewTime(now.Add(-ago)),
+			}}
+		}
+
+		return mirror
+	}
+
+	schedule := &imagev1.MirrorSchedule{ObjectMeta: metav1.ObjectMeta{Name: "nightly", Namespace: "default", UID: "uid"}}
+	owned := finishedMirror("owned", 2*time.Minute, ptr.To(int32(60)))
+	owned.OwnerReferences = []metav1.OwnerReference{*metav1.NewControllerRef(schedule, imagev1.GroupVersion.WithKind("MirrorSchedule"))}
+
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = imagev1.AddToScheme(scheme)
+
+	cli := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		finishedMirror("ttl-expired", 2*time.Minute, ptr.To(int32(60))),
+		// the TTL of the Mirror overrides the flag, either way
+		finishedMirror("ttl-not-expired", 20*time.Minute, ptr.To(int32(3600))),
+		finishedMirror("default-expired", 20*time.Minute, nil),
+		finishedMirror("default-not-expired", 5*time.Minute, nil),
+		finishedMirror("kept-forever", 48*time.Hour, ptr.To(int32(0))),
+		finishedMirror("running", 0, ptr.To(int32(60))),
+		// the history limits of the schedule delete it
+		owned,
+	).Build()
+
+	c := &mirrorCleaner{Client: cli, Recorder: record.NewFakeRecorder(10)}
+
+	next, err := c.clean(context.Background())
+	if err != nil {
+		t.Fatalf("clean() error = %v", err)
+	}
+
+	var mirrors imagev1.MirrorList
+	if err := cli.List(context.Background(), &mirrors, client.InNamespace("default")); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, mirror := range mirrors.Items {
+		names = append(names, mirror.Name)
+	}
+	slices.Sort(names)
+
+	if want := []string{"default-not-expired", "kept-forever", "owned", "running", "ttl-not-expired"}; !slices.Equal(names, want) {
+		t.Errorf("mirrors = %v, want %v", names, want)
+	}
+
+	// the Mirror finished 5 minutes ago expires first, with the default of 10 minutes
+	if want := now.Add(5 * time.Minute).Truncate(time.Second); !next.Truncate(time.Second).Equal(want) {
+		t.Errorf("next = %s, want %s", next, want)
+	}
+
+	// with the flag at 0 only the Mirrors with their own TTL expire
+	*cleanFinishedMirrorDuration = 0
+
+	if next, err = c.clean(context.Background()); err != nil {
+		t.Fatalf("clean() error = %v", err)
+	}
+
+	if want := now.Add(40 * time.Minute).Truncate(time.Second); !next.Truncate(time.Second).Equal(want) {
+		t.Errorf("next = %s, want %s", next, want)
+	}
+}
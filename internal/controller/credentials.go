@@ -0,0 +1,147 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/authn"
+	apiv1 "github.com/yxwuxuanl/k8s-image-operator/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"slices"
+	"strings"
+)
+
+// keys of the credentials Secret of a Mirror, each one is the docker config of a stage.
+const (
+	sourceCredentialsKey = "source"
+	targetCredentialsKey = "target"
+)
+
+// usesCredentialsSecret reports whether the credentials of mirror are merged into a Secret owned by the Mirror.
+func usesCredentialsSecret(mirror *apiv1.Mirror) bool {
+	return len(mirror.Spec.SourceCredentials) > 0 || len(mirror.Spec.TargetCredentials) > 0
+}
+
+func credentialsSecretName(mirror *apiv1.Mirror) string {
+	return mirror.Name + "-credentials"
+}
+
+// mirrorCredentials are the docker configs of the stages of a Mirror.
+type mirrorCredentials struct {
+	source, target []byte
+}
+
+// sourceKeychain returns the keychain of the source registries, the default keychain when c is nil.
+func (c *mirrorCredentials) sourceKeychain() (authn.Keychain, error) {
+	if c == nil {
+		return authn.DefaultKeychain, nil
+	}
+
+	return newDockerConfigKeychain(c.source)
+}
+
+// targetKeychain returns the keychain of the target registries, the default keychain when c is nil.
+func (c *mirrorCredentials) targetKeychain() (authn.Keychain, error) {
+	if c == nil {
+		return authn.DefaultKeychain, nil
+	}
+
+	return newDockerConfigKeychain(c.target)
+}
+
+// loadMirrorCredentials merges the Secrets of sourceCredentials and targetCredentials, dockerConfig is added to both.
+// It returns nil when mirror has no credentials.
+func loadMirrorCredentials(ctx context.Context, reader client.Reader, mirror *apiv1.Mirror) (*mirrorCredentials, error) {
+	sourceCredentials := slices.Clone(mirror.Spec.SourceCredentials)
+	targetCredentials := slices.Clone(mirror.Spec.TargetCredentials)
+
+	if dockerConfig := mirror.Spec.DockerConfig; dockerConfig != nil {
+		sourceCredentials = append(sourceCredentials, apiv1.RegistryCredential{SecretName: dockerConfig.SecretName})
+		targetCredentials = append(targetCredentials, apiv1.RegistryCredential{SecretName: dockerConfig.SecretName})
+	}
+
+	if len(sourceCredentials) == 0 && len(targetCredentials) == 0 {
+		return nil, nil
+	}
+
+	source, err := mergeDockerConfigs(ctx, reader, mirror.Namespace, sourceCredentials)
+	if err != nil {
+		return nil, fmt.Errorf("sourceCredentials: %w", err)
+	}
+
+	target, err := mergeDockerConfigs(ctx, reader, mirror.Namespace, targetCredentials)
+	if err != nil {
+		return nil, fmt.Errorf("targetCredentials: %w", err)
+	}
+
+	return &mirrorCredentials{source: source, target: target}, nil
+}
+
+// buildCredentialsSecret returns the Secret mounted by the containers of mirror, with a docker config per stage.
+func buildCredentialsSecret(mirror *apiv1.Mirror, credentials *mirrorCredentials) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      credentialsSecretName(mirror),
+			Namespace: mirror.Namespace,
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			sourceCredentialsKey: credentials.source,
+			targetCredentialsKey: credentials.target,
+		},
+	}
+}
+
+// mergeDockerConfigs returns a docker config with the auths of the Secrets of credentials
+// for their registries. The first Secret wins when several have the same registry.
+func mergeDockerConfigs(ctx context.Context, reader client.Reader, namespace string, credentials []apiv1.RegistryCredential) ([]byte, error) {
+	auths := make(map[string]json.RawMessage)
+
+	for i, credential := range credentials {
+		secret := &corev1.Secret{}
+		if err := reader.Get(ctx, client.ObjectKey{Namespace: namespace, Name: credential.SecretName}, secret); err != nil {
+			return nil, fmt.Errorf("[%d]: failed to get secret %s: %w", i, credential.SecretName, err)
+		}
+
+		if secret.Type != corev1.SecretTypeDockerConfigJson {
+			return nil, fmt.Errorf("[%d]: secret %s is not of type %s", i, credential.SecretName, corev1.SecretTypeDockerConfigJson)
+		}
+
+		var config struct {
+			Auths map[string]json.RawMessage `json:"auths"`
+		}
+
+		if err := json.Unmarshal(secret.Data[corev1.DockerConfigJsonKey], &config); err != nil {
+			return nil, fmt.Errorf("[%d]: failed to parse secret %s: %w", i, credential.SecretName, err)
+		}
+
+		for key, auth := range config.Auths {
+			if len(credential.Registries) > 0 && !slices.ContainsFunc(credential.Registries, func(registry string) bool {
+				return registryHost(registry) == registryHost(key)
+			}) {
+				continue
+			}
+
+			if _, ok := auths[key]; !ok {
+				auths[key] = auth
+			}
+		}
+	}
+
+	return json.Marshal(map[string]any{"auths": auths})
+}
+
+// registryHost returns the host of a registry or of a key of a docker config, with Docker Hub aliases folded.
+func registryHost(registry string) string {
+	host := strings.TrimPrefix(strings.TrimPrefix(registry, "https://"), "http://")
+	host, _, _ = strings.Cut(host, "/")
+
+	switch host {
+	case "index.docker.io", "registry-1.docker.io":
+		return "docker.io"
+	}
+
+	return host
+}
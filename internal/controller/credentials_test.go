@@ -0,0 +1,201 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	apiv1 "github.com/yxwuxuanl/k8s-image-operator/api/v1"
+	"github.com/yxwuxuanl/k8s-image-operator/internal/agent"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"maps"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"slices"
+	"testing"
+)
+
+// dockerConfigSecret returns a dockerconfigjson Secret with an auth per registry, the auth is the name of the Secret.
+func dockerConfigSecret(name string, registries ...string) *corev1.Secret {
+	auths := make(map[string]map[string]string)
+	for _, registry := range registries {
+		auths[registry] = map[string]string{"auth": name}
+	}
+
+	data, _ := json.Marshal(map[string]any{"auths": auths})
+
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data:       map[string][]byte{corev1.DockerConfigJsonKey: data},
+	}
+}
+
+func TestMergeDockerConfigs(t *testing.T) {
+	opaque := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "opaque", Namespace: "default"}, Type: corev1.SecretTypeOpaque}
+
+	invalid := dockerConfigSecret("invalid")
+	invalid.Data[corev1.DockerConfigJsonKey] = []byte("{")
+
+	reader := fake.NewClientBuilder().WithObjects(
+		dockerConfigSecret("dockerhub", "https://index.docker.io/v1/", "quay.io"),
+		dockerConfigSecret("myregistry", "myregistry:5000", "quay.io", "ghcr.io"),
+		opaque,
+		invalid,
+	).Build()
+
+	tests := []struct {
+		name        string
+		credentials []apiv1.RegistryCredential
+		// want is the name of the Secret whose auth is used, per key of the merged config
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name:        "first secret wins",
+			credentials: []apiv1.RegistryCredential{{SecretName: "dockerhub"}, {SecretName: "myregistry"}},
+			want: map[string]string{
+				"https://index.docker.io/v1/": "dockerhub",
+				"quay.io":                     "dockerhub",
+				"myregistry:5000":             "myregistry",
+				"ghcr.io":                     "myregistry",
+			},
+		},
+		{
+			name: "registries",
+			credentials: []apiv1.RegistryCredential{
+				{SecretName: "dockerhub", Registries: []string{"docker.io"}},
+				{SecretName: "myregistry", Registries: []string{"myregistry:5000", "quay.io"}},
+			},
+			want: map[string]string{
+				"https://index.docker.io/v1/": "dockerhub",
+				"myregistry:5000":             "myregistry",
+				"quay.io":                     "myregistry",
+			},
+		},
+		{
+			name:        "the port is part of the registry",
+			credentials: []apiv1.RegistryCredential{{SecretName: "myregistry", Registries: []string{"myregistry"}}},
+			want:        map[string]string{},
+		},
+		{
+			name:        "no credentials",
+			credentials: nil,
+			want:        map[string]string{},
+		},
+		{
+			name:        "missing secret",
+			credentials: []apiv1.RegistryCredential{{SecretName: "dockerhub"}, {SecretName: "missing"}},
+			wantErr:     true,
+		},
+		{
+			name:        "not a docker config",
+			credentials: []apiv1.RegistryCredential{{SecretName: "opaque"}},
+			wantErr:     true,
+		},
+		{
+			name:        "invalid docker config",
+			credentials: []apiv1.RegistryCredential{{SecretName: "invalid"}},
+			wantErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := mergeDockerConfigs(context.Background(), reader, "default", tt.credentials)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("mergeDockerConfigs() error = %v, want error %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			var config struct {
+				Auths map[string]struct {
+					Auth string `json:"auth"`
+				} `json:"auths"`
+			}
+
+			if err := json.Unmarshal(data, &config); err != nil {
+				t.Fatal(err)
+			}
+
+			got := make(map[string]string, len(config.Auths))
+			for key, auth := range config.Auths {
+				got[key] = auth.Auth
+			}
+
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("mergeDockerConfigs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegistryHost(t *testing.T) {
+	tests := []struct {
+		registry string
+		want     string
+	}{
+		{registry: "docker.io", want: "docker.io"},
+		{registry: "https://index.docker.io/v1/", want: "docker.io"},
+		{registry: "registry-1.docker.io", want: "docker.io"},
+		{registry: "http://myregistry:5000", want: "myregistry:5000"},
+		{registry: "quay.io/prometheus", want: "quay.io"},
+	}
+
+	for _, tt := range tests {
+		if got := registryHost(tt.registry); got != tt.want {
+			t.Errorf("registryHost(%s) = %s, want %s", tt.registry, got, tt.want)
+		}
+	}
+}
+
+func TestMirrorPodCredentials(t *testing.T) {
+	// mountedCredentials returns the docker config directories of the containers, by name
+	mountedCredentials := func(mirror *apiv1.Mirror) map[string][]string {
+		spec := buildMirrorPodTemplate(mirror, nil).Spec
+
+		mounted := make(map[string][]string)
+		for _, container := range append(spec.InitContainers, spec.Containers...) {
+			mounted[container.Name] = []string{}
+			for _, mount := range container.VolumeMounts {
+				if mount.Name == "credentials" {
+					mounted[container.Name] = append(mounted[container.Name], mount.SubPath)
+				}
+			}
+		}
+
+		return mounted
+	}
+
+	mirror := &apiv1.Mirror{
+		ObjectMeta: metav1.ObjectMeta{Name: "nginx", Namespace: "default"},
+		Spec: apiv1.MirrorSpec{
+			Images:            []apiv1.MirrorImage{{Source: "nginx:1.25", Target: "myregistry/nginx:1.25"}},
+			SourceCredentials: []apiv1.RegistryCredential{{SecretName: "dockerhub"}},
+			TargetCredentials: []apiv1.RegistryCredential{{SecretName: "myregistry"}},
+		},
+	}
+
+	want := map[string][]string{
+		agent.StageCheck: {sourceCredentialsKey, targetCredentialsKey},
+		agent.StagePull:  {sourceCredentialsKey},
+		agent.StagePush:  {targetCredentialsKey},
+	}
+	if got := mountedCredentials(mirror); !maps.EqualFunc(got, want, slices.Equal) {
+		t.Errorf("pull mode mounts %v, want %v", got, want)
+	}
+
+	// the push reads the referrers from the source
+	mirror.Spec.Images[0].CopyReferrers = true
+	want[agent.StagePush] = []string{sourceCredentialsKey, targetCredentialsKey}
+	if got := mountedCredentials(mirror); !maps.EqualFunc(got, want, slices.Equal) {
+		t.Errorf("copyReferrers mounts %v, want %v", got, want)
+	}
+
+	mirror.Spec.Mode = apiv1.MirrorModeCopy
+	want = map[string][]string{agent.StageCopy: {sourceCredentialsKey, targetCredentialsKey}}
+	if got := mountedCredentials(mirror); !maps.EqualFunc(got, want, slices.Equal) {
+		t.Errorf("copy mode mounts %v, want %v", got, want)
+	}
+}
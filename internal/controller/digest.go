@@ -0,0 +1,203 @@
+package controller
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/yxwuxuanl/k8s-image-operator/internal/reference"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strings"
+	"sync"
+	"time"
+)
+
+var digestCacheTTL = flag.Duration("digest-cache-ttl", 5*time.Minute, "how long a resolved image digest is cached")
+
+// digestResolver resolves image tags to manifest digests for rules with pinDigest.
+type digestResolver struct {
+	// reader reads Secrets directly from the API server, so that we don't cache every Secret in the cluster.
+	reader client.Reader
+	cache  *digestCache
+
+	// remoteOptions are appended to the options of every registry request.
+	remoteOptions []remote.Option
+}
+
+func newDigestResolver(reader client.Reader, remoteOptions ...remote.Option) *digestResolver {
+	return &digestResolver{
+		reader:        reader,
+		cache:         newDigestCache(*digestCacheTTL),
+		remoteOptions: remoteOptions,
+	}
+}
+
+// resolve returns the manifest digest of ref within the deadline of ctx. Credentials are read from
+// the dockerconfigjson Secret referenced by dockerConfig, if any.
+func (d *digestResolver) resolve(ctx context.Context, ref reference.Reference, dockerConfig *corev1.SecretReference) (string, error) {
+	if ref.Digest != "" {
+		return ref.Digest, nil
+	}
+
+	image := ref.String()
+
+	// a digest resolved with the credentials of a Secret is only served to the rules using that Secret,
+	// a rule without credentials must not learn the digest of a private image
+	key := image
+	if dockerConfig != nil {
+		key += " " + dockerConfig.Namespace + "/" + dockerConfig.Name
+	}
+
+	if digest, ok := d.cache.get(key); ok {
+		return digest, nil
+	}
+
+	nameRef, err := name.ParseReference(image)
+	if err != nil {
+		return "", err
+	}
+
+	var keychain authn.Keychain = authn.DefaultKeychain
+	if dockerConfig != nil {
+		if keychain, err = d.keychain(ctx, dockerConfig); err != nil {
+			return "", err
+		}
+	}
+
+	desc, err := remote.Head(nameRef, d.options(ctx, keychain)...)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve digest of %s: %w", image, err)
+	}
+
+	digest := desc.Digest.String()
+	d.cache.set(key, digest)
+
+	return digest, nil
+}
+
+// options returns the options of a registry request authenticated with keychain.
+func (d *digestResolver) options(ctx context.Context, keychain authn.Keychain) []remote.Option {
+	return append([]remote.Option{
+		remote.WithContext(ctx),
+		remote.WithAuthFromKeychain(keychain),
+	}, d.remoteOptions...)
+}
+
+func (d *digestResolver) keychain(ctx context.Context, ref *corev1.SecretReference) (authn.Keychain, error) {
+	secret := &corev1.Secret{}
+	if err := d.reader.Get(ctx, client.ObjectKey{Namespace: ref.Namespace, Name: ref.Name}, secret); err != nil {
+		return nil, fmt.Errorf("failed to get secret %s/%s: %w", ref.Namespace, ref.Name, err)
+	}
+
+	if secret.Type != corev1.SecretTypeDockerConfigJson {
+		return nil, fmt.Errorf("secret %s/%s is not of type %s", ref.Namespace, ref.Name, corev1.SecretTypeDockerConfigJson)
+	}
+
+	keychain, err := newDockerConfigKeychain(secret.Data[corev1.DockerConfigJsonKey])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse secret %s/%s: %w", ref.Namespace, ref.Name, err)
+	}
+
+	return keychain, nil
+}
+
+// newDockerConfigKeychain returns a keychain with the auths of the content of a .dockerconfigjson.
+func newDockerConfigKeychain(data []byte) (authn.Keychain, error) {
+	var config dockerConfigKeychain
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+// dockerConfigKeychain is an authn.Keychain backed by the content of a .dockerconfigjson.
+type dockerConfigKeychain struct {
+	Auths map[string]authn.AuthConfig `json:"auths"`
+}
+
+func (k *dockerConfigKeychain) Resolve(resource authn.Resource) (authn.Authenticator, error) {
+	registry := resource.RegistryStr()
+
+	for key, config := range k.Auths {
+		if registryHost(key) != registryHost(registry) {
+			continue
+		}
+
+		if config.Auth != "" && config.Username == "" {
+			decoded, err := base64.StdEncoding.DecodeString(config.Auth)
+			if err != nil {
+				return nil, err
+			}
+
+			config.Username, config.Password, _ = strings.Cut(string(decoded), ":")
+			config.Auth = ""
+		}
+
+		return authn.FromConfig(config), nil
+	}
+
+	return authn.Anonymous, nil
+}
+
+type digestCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]digestCacheEntry
+}
+
+type digestCacheEntry struct {
+	digest  string
+	expires time.Time
+}
+
+func newDigestCache(ttl time.Duration) *digestCache {
+	return &digestCache{
+		ttl:     ttl,
+		entries: make(map[string]digestCacheEntry),
+	}
+}
+
+func (c *digestCache) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+
+	if time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return "", false
+	}
+
+	return entry.digest, true
+}
+
+func (c *digestCache) set(key, digest string) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for k, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, k)
+		}
+	}
+
+	c.entries[key] = digestCacheEntry{
+		digest:  digest,
+		expires: now.Add(c.ttl),
+	}
+}
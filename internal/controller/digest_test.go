@@ -0,0 +1,269 @@
+package controller
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"io"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testRegistry is an in-process registry counting the manifest requests it serves.
+type testRegistry struct {
+	*httptest.Server
+	manifests atomic.Int32
+}
+
+// newTestRegistry starts an in-memory registry, behind wrap when it is not nil.
+func newTestRegistry(t *testing.T, wrap func(http.Handler) http.Handler) *testRegistry {
+	r := &testRegistry{}
+
+	var handler http.Handler = registry.New(registry.Logger(log.New(io.Discard, "", 0)))
+	if wrap != nil {
+		handler = wrap(handler)
+	}
+
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.Contains(req.URL.Path, "/manifests/") {
+			r.manifests.Add(1)
+		}
+
+		handler.ServeHTTP(w, req)
+	}))
+	t.Cleanup(r.Close)
+
+	return r
+}
+
+// push pushes a random image to repository:tag and returns its reference and digest.
+func (r *testRegistry) push(t *testing.T, repository, tag string, options ...remote.Option) (string, string) {
+	image, err := random.Image(256, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ref := fmt.Sprintf("%s/%s:%s", strings.TrimPrefix(r.URL, "http://"), repository, tag)
+
+	nameRef, err := name.ParseReference(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := remote.Write(nameRef, image, options...); err != nil {
+		t.Fatal(err)
+	}
+
+	digest, err := image.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ref, digest.String()
+}
+
+func TestDigestResolverResolve(t *testing.T) {
+	reg := newTestRegistry(t, nil)
+	image, digest := reg.push(t, "app", "v1")
+	reg.manifests.Store(0)
+
+	resolver := newDigestResolver(fake.NewClientBuilder().Build(), remote.WithTransport(reg.Client().Transport))
+	ctx := context.Background()
+
+	ref, err := normalizeImage(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		got, err := resolver.resolve(ctx, ref, nil)
+		if err != nil {
+			t.Fatalf("resolve() error = %v", err)
+		}
+
+		if got != digest {
+			t.Errorf("resolve() = %s, want %s", got, digest)
+		}
+	}
+
+	if n := reg.manifests.Load(); n != 1 {
+		t.Errorf("registry served %d manifest requests, want the second resolve to be cached", n)
+	}
+
+	// a reference with a digest is not resolved
+	if got, err := resolver.resolve(ctx, ref.WithDigest(testDigest), nil); err != nil || got != testDigest {
+		t.Errorf("resolve() of a digest = %s, %v, want %s", got, err, testDigest)
+	}
+}
+
+func TestDigestResolverCredentials(t *testing.T) {
+	const username, password = "user", "secret"
+
+	reg := newTestRegistry(t, func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if user, pass, ok := req.BasicAuth(); !ok || user != username || pass != password {
+				w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			next.ServeHTTP(w, req)
+		})
+	})
+
+	host := strings.TrimPrefix(reg.URL, "http://")
+	auth := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+
+	image, digest := reg.push(t, "private", "v1", remote.WithAuth(authn.FromConfig(authn.AuthConfig{Username: username, Password: password})))
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "registry", Namespace: "default"},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{
+			corev1.DockerConfigJsonKey: []byte(fmt.Sprintf(`{"auths":{%q:{"auth":%q}}}`, host, auth)),
+		},
+	}
+
+	resolver := newDigestResolver(fake.NewClientBuilder().WithObjects(secret).Build(), remote.WithTransport(reg.Client().Transport))
+	ctx := context.Background()
+
+	ref, err := normalizeImage(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := resolver.resolve(ctx, ref, &corev1.SecretReference{Name: "registry", Namespace: "default"})
+	if err != nil || got != digest {
+		t.Fatalf("resolve() with credentials = %s, %v, want %s", got, err, digest)
+	}
+
+	// the digest resolved with the credentials is not served to a rule without them
+	if got, err := resolver.resolve(ctx, ref, nil); err == nil {
+		t.Errorf("resolve() without credentials = %s, want an error", got)
+	}
+
+	if _, err := resolver.resolve(ctx, ref, &corev1.SecretReference{Name: "missing", Namespace: "default"}); err == nil {
+		t.Error("resolve() with a missing Secret succeeded, want an error")
+	}
+}
+
+func TestPinDigestsWebhookTimeout(t *testing.T) {
+	// the registry stops answering manifest requests once the images are pushed
+	var slow atomic.Bool
+
+	reg := newTestRegistry(t, func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if slow.Load() && strings.Contains(req.URL.Path, "/manifests/") {
+				select {
+				case <-req.Context().Done():
+				case <-time.After(10 * time.Second):
+				}
+				return
+			}
+
+			next.ServeHTTP(w, req)
+		})
+	})
+
+	first, _ := reg.push(t, "first", "v1")
+	second, _ := reg.push(t, "second", "v1")
+	slow.Store(true)
+
+	timeoutSeconds := *webhookTimeoutSeconds
+	*webhookTimeoutSeconds = 1
+	t.Cleanup(func() { *webhookTimeoutSeconds = timeoutSeconds })
+
+	for _, policy := range []admissionregistrationv1.FailurePolicyType{admissionregistrationv1.Fail, admissionregistrationv1.Ignore} {
+		t.Run(string(policy), func(t *testing.T) {
+			rule := newRule()
+			rule.Spec.PinDigest = true
+			rule.Spec.FailurePolicy = string(policy)
+
+			rs, err := compileRuleSet(rule)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pod := &corev1.Pod{}
+			pod.Spec.Containers = []corev1.Container{
+				{Name: "first", Image: first},
+				{Name: "second", Image: second},
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), admissionTimeout())
+			defer cancel()
+
+			start := time.Now()
+			mutations, err := mutatePod(ctx, rs, newDigestResolver(fake.NewClientBuilder().Build(), remote.WithTransport(reg.Client().Transport)), pod, &corev1.Pod{})
+
+			// the images are resolved concurrently, the pod is answered within the timeout of the webhook
+			if elapsed := time.Since(start); elapsed >= time.Duration(*webhookTimeoutSeconds)*time.Second {
+				t.Errorf("mutatePod() took %s, want less than the webhook timeout", elapsed)
+			}
+
+			if policy == admissionregistrationv1.Ignore {
+				if err != nil || len(mutations) != 0 {
+					t.Errorf("mutatePod() = %v, %v, want the pod admitted unchanged", mutations, err)
+				}
+				return
+			}
+
+			var denial *denyError
+			if !errors.As(err, &denial) || denial.reason != DenyReasonPinDigest {
+				t.Errorf("mutatePod() error = %v, want a %s denial", err, DenyReasonPinDigest)
+			}
+		})
+	}
+}
+
+func TestPinDigestsPinned(t *testing.T) {
+	reg := newTestRegistry(t, nil)
+	image, digest := reg.push(t, "app", "v1")
+	reg.manifests.Store(0)
+
+	rule := newRule()
+	rule.Spec.PinDigest = true
+
+	rs, err := compileRuleSet(rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pod := &corev1.Pod{}
+	pod.Spec.Containers = []corev1.Container{
+		{Name: "pinned", Image: "nginx@" + testDigest},
+		{Name: "tag-and-digest", Image: image + "@" + digest},
+		{Name: "tag", Image: image},
+	}
+
+	resolver := newDigestResolver(fake.NewClientBuilder().Build(), remote.WithTransport(reg.Client().Transport))
+
+	mutations, err := mutatePod(context.Background(), rs, resolver, pod, &corev1.Pod{})
+	if err != nil {
+		t.Fatalf("mutatePod() error = %v", err)
+	}
+
+	// the pinned images are neither patched into their normalized form nor resolved
+	if len(mutations) != 1 || mutations[0].name != "tag" || !strings.HasSuffix(mutations[0].image, "@"+digest) {
+		t.Errorf("mutations = %+v, want only the tag pinned to %s", mutations, digest)
+	}
+
+	if n := reg.manifests.Load(); n != 1 {
+		t.Errorf("registry served %d manifest requests, want 1", n)
+	}
+}
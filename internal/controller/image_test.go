@@ -0,0 +1,91 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	corev1 "k8s.io/api/core/v1"
+	"testing"
+)
+
+const testDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func TestNormalizeImage(t *testing.T) {
+	tests := []struct {
+		image string
+		want  string
+		tag   string
+	}{
+		{image: "nginx", want: "docker.io/library/nginx:latest", tag: "latest"},
+		{image: "nginx:1.25", want: "docker.io/library/nginx:1.25", tag: "1.25"},
+		{image: "bitnami/redis", want: "docker.io/bitnami/redis:latest", tag: "latest"},
+		{image: "index.docker.io/nginx", want: "docker.io/library/nginx:latest", tag: "latest"},
+		{image: "myregistry:5000/app", want: "myregistry:5000/app:latest", tag: "latest"},
+		{image: "myregistry:5000/app:v1", want: "myregistry:5000/app:v1", tag: "v1"},
+		{image: "localhost/app", want: "localhost/app:latest", tag: "latest"},
+		{image: "nginx@" + testDigest, want: "docker.io/library/nginx@" + testDigest},
+		{image: "nginx:1.25@" + testDigest, want: "docker.io/library/nginx:1.25@" + testDigest, tag: "1.25"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			ref, err := normalizeImage(tt.image)
+			if err != nil {
+				t.Fatalf("normalizeImage(%q) error = %v", tt.image, err)
+			}
+
+			if ref.String() != tt.want || ref.Tag != tt.tag {
+				t.Errorf("normalizeImage(%q) = %q with tag %q, want %q with tag %q", tt.image, ref, ref.Tag, tt.want, tt.tag)
+			}
+		})
+	}
+
+	if _, err := normalizeImage("Nginx"); err == nil {
+		t.Error("normalizeImage(\"Nginx\") succeeded, want an error")
+	}
+}
+
+func TestMutatePodDisallowedTags(t *testing.T) {
+	rule := newRule()
+	rule.Spec.DisallowedTags = []string{"latest"}
+
+	rs, err := compileRuleSet(rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		image  string
+		reason string
+	}{
+		{image: "nginx", reason: DenyReasonDisallowedTag},
+		{image: "nginx:latest", reason: DenyReasonDisallowedTag},
+		{image: "myregistry:5000/app", reason: DenyReasonDisallowedTag},
+		{image: "myregistry:5000/app:latest", reason: DenyReasonDisallowedTag},
+		{image: "nginx:1.25"},
+		{image: "myregistry:5000/app:v1"},
+		{image: "nginx@" + testDigest},
+		// the tag of an image that can't be parsed is unknown
+		{image: "Nginx:latest", reason: DenyReasonInvalidImage},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			pod := &corev1.Pod{}
+			pod.Spec.Containers = []corev1.Container{{Name: "app", Image: tt.image}}
+
+			_, err := mutatePod(context.Background(), rs, nil, pod, &corev1.Pod{})
+
+			var (
+				denial *denyError
+				reason string
+			)
+			if errors.As(err, &denial) {
+				reason = denial.reason
+			}
+
+			if reason != tt.reason {
+				t.Errorf("mutatePod(%q) error = %v, want denied with %q", tt.image, err, tt.reason)
+			}
+		})
+	}
+}
@@ -0,0 +1,366 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"github.com/yxwuxuanl/k8s-image-operator/internal/reference"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	imagev1 "github.com/yxwuxuanl/k8s-image-operator/api/v1"
+)
+
+var inventoryResyncInterval = flag.Duration("inventory-resync-interval", 5*time.Minute, "how often image inventories are recomputed without Pod changes")
+
+// ImageInventoryReconciler reconciles an ImageInventory object
+type ImageInventoryReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+}
+
+//+kubebuilder:rbac:groups=image.lin2ur.cn,resources=imageinventories,verbs=get;list;watch
+//+kubebuilder:rbac:groups=image.lin2ur.cn,resources=imageinventories/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=image.lin2ur.cn,resources=imageinventories/finalizers,verbs=update
+//+kubebuilder:rbac:groups=core,resources=namespaces,verbs=get;list;watch
+
+// Reconcile lists the images of the Pods in the selected namespaces, and creates a Mirror
+// for them when spec.mirror is set and they changed since the last Mirror.
+func (r *ImageInventoryReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	inventory := &imagev1.ImageInventory{}
+	if err := r.Get(ctx, req.NamespacedName, inventory); err != nil {
+		// the series of the images its Mirrors mirrored are removed with it
+		if errors.IsNotFound(err) {
+			deleteMirrorMetrics(req.Namespace, "ImageInventory/"+req.Name)
+		}
+
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	images, err := r.listImages(ctx, inventory)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	status := inventory.Status.DeepCopy()
+	status.Images = images
+
+	if inventory.Spec.Mirror != nil {
+		spec, skipped := inventoryMirrorSpec(inventory.Spec.Mirror, images)
+
+		for i := range status.Images {
+			image := &status.Images[i]
+			if image.Skipped = skipped[image.Image]; image.Skipped != "" && !inventorySkipped(&inventory.Status, image.Image) {
+				r.Recorder.Eventf(inventory, corev1.EventTypeWarning, "ImageSkipped", "Image %s is not mirrored: %s", image.Image, image.Skipped)
+			}
+		}
+
+		if status.Mirror, err = r.syncMirror(ctx, inventory, spec); err != nil {
+			r.Recorder.Eventf(inventory, corev1.EventTypeWarning, "MirrorCreateFailed", "Failed to create Mirror: %s", err)
+			return ctrl.Result{}, err
+		}
+	}
+
+	if !equality.Semantic.DeepEqual(status.Images, inventory.Status.Images) {
+		status.LastUpdateTime = &metav1.Time{Time: time.Now()}
+	}
+
+	if !equality.Semantic.DeepEqual(status, &inventory.Status) {
+		inventory.Status = *status
+		if err := r.Status().Update(ctx, inventory); err != nil {
+			return ctrl.Result{}, fmt.Errorf("unable to update image inventory status: %w", err)
+		}
+	}
+
+	return ctrl.Result{RequeueAfter: *inventoryResyncInterval}, nil
+}
+
+// listImages returns the distinct images of the running Pods in the namespaces selected by inventory.
+func (r *ImageInventoryReconciler) listImages(ctx context.Context, inventory *imagev1.ImageInventory) ([]imagev1.InventoryImage, error) {
+	var namespaces sets.Set[string]
+
+	if inventory.Spec.NamespaceSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(inventory.Spec.NamespaceSelector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid namespaceSelector: %w", err)
+		}
+
+		var namespaceList corev1.NamespaceList
+		if err := r.List(ctx, &namespaceList, client.MatchingLabelsSelector{Selector: selector}); err != nil {
+			return nil, fmt.Errorf("unable to list namespaces: %w", err)
+		}
+
+		namespaces = sets.New[string]()
+		for _, namespace := range namespaceList.Items {
+			namespaces.Insert(namespace.Name)
+		}
+	}
+
+	var pods corev1.PodList
+	if err := r.List(ctx, &pods); err != nil {
+		return nil, fmt.Errorf("unable to list pods: %w", err)
+	}
+
+	counts := make(map[string]int32)
+	for _, pod := range pods.Items {
+		if namespaces != nil && !namespaces.Has(pod.Namespace) {
+			continue
+		}
+
+		// mirror pods run the operator image, which is not what the workloads use
+		if _, ok := pod.Annotations[MirrorAnnotation]; ok {
+			continue
+		}
+
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+
+		podImages := sets.New[string]()
+		for _, container := range slices.Concat(pod.Spec.InitContainers, pod.Spec.Containers) {
+			if ref, err := normalizeImage(container.Image); err == nil {
+				podImages.Insert(ref.String())
+			}
+		}
+
+		for image := range podImages {
+			counts[image]++
+		}
+	}
+
+	images := make([]imagev1.InventoryImage, 0, len(counts))
+	for image, pods := range counts {
+		images = append(images, imagev1.InventoryImage{Image: image, Pods: pods})
+	}
+
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].Image < images[j].Image
+	})
+
+	return images, nil
+}
+
+// inventorySkipped reports whether image was already skipped in status.
+func inventorySkipped(status *imagev1.ImageInventoryStatus, image string) bool {
+	for _, inventoryImage := range status.Images {
+		if inventoryImage.Image == image {
+			return inventoryImage.Skipped != ""
+		}
+	}
+
+	return false
+}
+
+// syncMirror creates the Mirror of spec if it doesn't exist yet, and deletes
+// the finished Mirrors of previous images. It returns the name of the Mirror.
+func (r *ImageInventoryReconciler) syncMirror(ctx context.Context, inventory *imagev1.ImageInventory, spec imagev1.MirrorSpec) (string, error) {
+	if len(spec.Images) == 0 {
+		return "", nil
+	}
+
+	// the Mirror is named after its images, a new one is created when they change
+	h := sha256.New()
+	for _, image := range spec.Images {
+		h.Write([]byte(image.Source + " " + image.Target + "\n"))
+	}
+
+	name := fmt.Sprintf("%s-%s", inventory.Name, hex.EncodeToString(h.Sum(nil))[:10])
+
+	var mirrors imagev1.MirrorList
+	if err := r.List(ctx, &mirrors, client.InNamespace(inventory.Namespace), client.MatchingFields{mirrorOwnerKey: "ImageInventory/" + inventory.Name}); err != nil {
+		return "", fmt.Errorf("unable to list mirrors: %w", err)
+	}
+
+	var exists bool
+	for i := range mirrors.Items {
+		mirror := &mirrors.Items[i]
+		if mirror.Name == name {
+			exists = true
+			continue
+		}
+
+		// a running Mirror is left to finish, images it already copied are skipped by the new one
+		if finishedType, _ := mirrorFinished(mirror); finishedType == "" {
+			continue
+		}
+
+		if err := r.Delete(ctx, mirror, client.PropagationPolicy(metav1.DeletePropagationBackground)); client.IgnoreNotFound(err) != nil {
+			log.FromContext(ctx).Error(err, "unable to delete previous mirror", "mirror", mirror.Name)
+			continue
+		}
+	}
+
+	if exists {
+		return name, nil
+	}
+
+	mirror := &imagev1.Mirror{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: inventory.Namespace,
+		},
+		Spec: spec,
+	}
+
+	if err := ctrl.SetControllerReference(inventory, mirror, r.Scheme); err != nil {
+		return "", err
+	}
+
+	if err := r.Create(ctx, mirror); err != nil && !errors.IsAlreadyExists(err) {
+		return "", err
+	}
+
+	r.Recorder.Eventf(inventory, corev1.EventTypeNormal, "MirrorCreated", "Created Mirror %s to mirror %d images", name, len(spec.Images))
+
+	return name, nil
+}
+
+// inventoryMirrorSpec returns the spec of the Mirror that copies images under the target prefix of mirror.
+// Images already under the prefix are left out, images that can't be mirrored are returned
+// in skipped with the reason.
+func inventoryMirrorSpec(mirror *imagev1.InventoryMirror, images []imagev1.InventoryImage) (spec imagev1.MirrorSpec, skipped map[string]string) {
+	spec = imagev1.MirrorSpec{
+		Mode:         mirror.Mode,
+		Parallelism:  mirror.Parallelism,
+		DockerConfig: mirror.DockerConfig,
+	}
+
+	prefix := strings.TrimSuffix(mirror.TargetPrefix, "/")
+
+	var normalizedPrefix string
+	if ref, err := reference.ParseNormalized(prefix); err == nil {
+		normalizedPrefix = ref.Name() + "/"
+	}
+
+	skipped = make(map[string]string)
+
+	for _, image := range images {
+		ref, err := reference.ParseNormalized(image.Image)
+		if err != nil {
+			skipped[image.Image] = err.Error()
+			continue
+		}
+
+		if normalizedPrefix != "" && strings.HasPrefix(ref.Name()+"/", normalizedPrefix) {
+			continue
+		}
+
+		// the target has to be tagged, there is no tag to give an image pulled by digest only
+		if ref.Tag == "" {
+			skipped[image.Image] = "the image has no tag"
+			continue
+		}
+
+		spec.Images = append(spec.Images, imagev1.MirrorImage{
+			Source: ref.String(),
+			Target: fmt.Sprintf("%s/%s/%s:%s", prefix, domainPathComponent(ref), ref.Path, ref.Tag),
+		})
+	}
+
+	// the webhook rejects a parallelism greater than the number of images
+	spec.Parallelism = min(spec.Parallelism, int32(len(spec.Images)))
+
+	return spec, skipped
+}
+
+// domainPathComponent returns the registry of ref as a path component of a repository,
+// a port is joined with a '-', e.g. registry:5000 becomes registry-5000.
+func domainPathComponent(ref reference.Reference) string {
+	domain := strings.Trim(ref.Hostname(), "[]")
+	if port := ref.Port(); port != "" {
+		domain += ":" + port
+	}
+
+	// the colons of an IPv6 address are replaced too, a component must not start with a separator
+	return strings.Trim(strings.ReplaceAll(strings.ToLower(domain), ":", "-"), "-")
+}
+
+// podImagesChanged reports whether the images used by a Pod changed, or it stopped using them.
+func podImagesChanged(oldPod, newPod *corev1.Pod) bool {
+	podImages := func(pod *corev1.Pod) []string {
+		var images []string
+		for _, container := range slices.Concat(pod.Spec.InitContainers, pod.Spec.Containers) {
+			images = append(images, container.Image)
+		}
+
+		return images
+	}
+
+	finished := func(pod *corev1.Pod) bool {
+		return pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed
+	}
+
+	return finished(oldPod) != finished(newPod) || !slices.Equal(podImages(oldPod), podImages(newPod))
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *ImageInventoryReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	// every inventory is recomputed when a Pod changes, the queue collapses bursts of Pod events
+	podEnqueueFunc := handler.EnqueueRequestsFromMapFunc(func(ctx context.Context, object client.Object) []reconcile.Request {
+		var inventories imagev1.ImageInventoryList
+		if err := mgr.GetClient().List(ctx, &inventories); err != nil {
+			log.FromContext(ctx).Error(err, "unable to list image inventories")
+			return nil
+		}
+
+		requests := make([]reconcile.Request, 0, len(inventories.Items))
+		for _, inventory := range inventories.Items {
+			requests = append(requests, reconcile.Request{
+				NamespacedName: client.ObjectKeyFromObject(&inventory),
+			})
+		}
+
+		return requests
+	})
+
+	podPred := builder.WithPredicates(predicate.Funcs{
+		UpdateFunc: func(updateEvent event.UpdateEvent) bool {
+			return podImagesChanged(updateEvent.ObjectOld.(*corev1.Pod), updateEvent.ObjectNew.(*corev1.Pod))
+		},
+		GenericFunc: func(genericEvent event.GenericEvent) bool {
+			return false
+		},
+	})
+
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&imagev1.ImageInventory{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Owns(&imagev1.Mirror{}).
+		Watches(&corev1.Pod{}, podEnqueueFunc, podPred).
+		Complete(r)
+}
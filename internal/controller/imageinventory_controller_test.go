@@ -0,0 +1,57 @@
+package controller
+
+import (
+	imagev1 "github.com/yxwuxuanl/k8s-image-operator/api/v1"
+	"github.com/yxwuxuanl/k8s-image-operator/internal/reference"
+	"testing"
+)
+
+func TestInventoryMirrorSpec(t *testing.T) {
+	tests := []struct {
+		image   string
+		target  string
+		skipped bool
+	}{
+		{image: "docker.io/library/nginx:1.25", target: "myregistry/mirror/docker.io/library/nginx:1.25"},
+		{image: "registry:5000/app:v1", target: "myregistry/mirror/registry-5000/app:v1"},
+		{image: "Registry.Example.com:5000/team/app:v1", target: "myregistry/mirror/registry.example.com-5000/team/app:v1"},
+		{image: "[::1]:5000/app:v1", target: "myregistry/mirror/1-5000/app:v1"},
+		{image: "docker.io/library/nginx:1.25@" + testDigest, target: "myregistry/mirror/docker.io/library/nginx:1.25"},
+		{image: "docker.io/library/nginx@" + testDigest, skipped: true},
+		{image: "myregistry/mirror/docker.io/library/redis:7"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			spec, skipped := inventoryMirrorSpec(
+				&imagev1.InventoryMirror{TargetPrefix: "myregistry/mirror/", Parallelism: 5},
+				[]imagev1.InventoryImage{{Image: tt.image, Pods: 1}},
+			)
+
+			if _, ok := skipped[tt.image]; ok != tt.skipped {
+				t.Errorf("skipped = %v, want %v", skipped, tt.skipped)
+			}
+
+			var target string
+			if len(spec.Images) > 0 {
+				target = spec.Images[0].Target
+			}
+
+			if target != tt.target {
+				t.Fatalf("target = %q, want %q", target, tt.target)
+			}
+
+			if target == "" {
+				return
+			}
+
+			if _, err := reference.Parse(target); err != nil {
+				t.Errorf("target %q is not a valid reference: %v", target, err)
+			}
+
+			if spec.Parallelism != 1 {
+				t.Errorf("parallelism = %d, want it capped to the number of images", spec.Parallelism)
+			}
+		})
+	}
+}
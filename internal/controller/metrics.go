@@ -0,0 +1,105 @@
+package controller
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	imagev1 "github.com/yxwuxuanl/k8s-image-operator/api/v1"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const metricsNamespace = "image_operator"
+
+var (
+	admissionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "admissions_total",
+		Help:      "Number of pod admissions handled per rule.",
+	}, []string{"rule"})
+
+	containersRewrittenTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "containers_rewritten_total",
+		Help:      "Number of container images rewritten per rule and source registry.",
+	}, []string{"rule", "registry"})
+
+	denialsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "denials_total",
+		Help:      "Number of pods denied per rule and reason.",
+	}, []string{"rule", "reason"})
+
+	podsWarnedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "pods_warned_total",
+		Help:      "Number of pods a rule in warn or dryRun mode would have mutated or denied, per rule and enforcement action.",
+	}, []string{"rule", "enforcement_action"})
+
+	admissionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "admission_duration_seconds",
+		Help:      "Latency of the pod mutate handler per rule.",
+		Buckets:   []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+	}, []string{"rule"})
+
+	mirrorImagesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "mirror_images_total",
+		Help:      "Number of images mirrored per Mirror, or owner of the Mirror, and result (Succeeded, Skipped or Failed).",
+	}, []string{"namespace", "mirror", "result"})
+
+	mirrorImagesInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "mirror_images_in_flight",
+		Help:      "Number of images being mirrored per Mirror.",
+	}, []string{"namespace", "mirror"})
+
+	mirrorCopyDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "mirror_copy_duration_seconds",
+		Help:      "Duration of the copy of an image per Mirror, or owner of the Mirror.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 13),
+	}, []string{"namespace", "mirror"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		admissionsTotal,
+		containersRewrittenTotal,
+		denialsTotal,
+		podsWarnedTotal,
+		admissionDuration,
+		mirrorImagesTotal,
+		mirrorImagesInFlight,
+		mirrorCopyDuration,
+	)
+}
+
+// deleteRuleMetrics removes the series of a Rule once it has been deleted, it is called by the Rule reconciler.
+func deleteRuleMetrics(name string) {
+	labels := prometheus.Labels{"rule": name}
+
+	admissionsTotal.DeletePartialMatch(labels)
+	containersRewrittenTotal.DeletePartialMatch(labels)
+	denialsTotal.DeletePartialMatch(labels)
+	podsWarnedTotal.DeletePartialMatch(labels)
+	admissionDuration.DeletePartialMatch(labels)
+}
+
+// mirrorMetricsName returns the mirror label of the images mirrored by mirror: the kind and name of its owner
+// for the Mirrors a MirrorSchedule or ImageInventory creates, so their generated names don't add a series per run.
+func mirrorMetricsName(mirror *imagev1.Mirror) string {
+	if owner := mirrorOwner(mirror); owner != "" {
+		return owner
+	}
+
+	return mirror.Name
+}
+
+// deleteMirrorMetrics removes the series of a Mirror, or of the owner of Mirrors, once it has been deleted.
+// It is called by the reconciler of the deleted object.
+func deleteMirrorMetrics(namespace, name string) {
+	labels := prometheus.Labels{"namespace": namespace, "mirror": name}
+
+	mirrorImagesTotal.DeletePartialMatch(labels)
+	mirrorImagesInFlight.DeletePartialMatch(labels)
+	mirrorCopyDuration.DeletePartialMatch(labels)
+}
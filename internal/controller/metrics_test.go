@@ -0,0 +1,79 @@
+package controller
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	imagev1 "github.com/yxwuxuanl/k8s-image-operator/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"testing"
+)
+
+func TestReconcileDeletedRuleMetrics(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = imagev1.AddToScheme(scheme)
+
+	for _, rule := range []string{"deleted", "kept"} {
+		admissionsTotal.WithLabelValues(rule).Inc()
+		containersRewrittenTotal.WithLabelValues(rule, "docker.io").Inc()
+		denialsTotal.WithLabelValues(rule, DenyReasonDisallowedTag).Inc()
+		podsWarnedTotal.WithLabelValues(rule, "warn").Inc()
+		admissionDuration.WithLabelValues(rule).Observe(0.01)
+	}
+	t.Cleanup(func() { deleteRuleMetrics("kept") })
+
+	r := &RuleReconciler{Client: fake.NewClientBuilder().WithScheme(scheme).Build(), Scheme: scheme, Recorder: record.NewFakeRecorder(10)}
+
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: "deleted"}}
+	if _, err := r.Reconcile(context.Background(), req); err != nil {
+		t.Fatalf("Reconcile: %s", err)
+	}
+
+	// only the series of the other rule are left
+	if n := testutil.CollectAndCount(admissionsTotal) + testutil.CollectAndCount(containersRewrittenTotal) +
+		testutil.CollectAndCount(denialsTotal) + testutil.CollectAndCount(podsWarnedTotal) +
+		testutil.CollectAndCount(admissionDuration); n != 5 {
+		t.Errorf("%d series left, want the 5 of the other rule", n)
+	}
+}
+
+func TestMirrorMetricsName(t *testing.T) {
+	mirror := &imagev1.Mirror{ObjectMeta: metav1.ObjectMeta{Name: "nightly-28290240", Namespace: "default"}}
+	if got := mirrorMetricsName(mirror); got != "nightly-28290240" {
+		t.Errorf("mirrorMetricsName() = %s, want the name of the Mirror", got)
+	}
+
+	schedule := &imagev1.MirrorSchedule{ObjectMeta: metav1.ObjectMeta{Name: "nightly", Namespace: "default"}}
+	mirror.OwnerReferences = []metav1.OwnerReference{
+		*metav1.NewControllerRef(schedule, imagev1.GroupVersion.WithKind("MirrorSchedule")),
+	}
+
+	if got := mirrorMetricsName(mirror); got != "MirrorSchedule/nightly" {
+		t.Errorf("mirrorMetricsName() = %s, want the owner", got)
+	}
+
+	// the runs of the schedule share its series, which are removed with it
+	recordMirrorImageMetrics(mirror, string(corev1.PodSucceeded))
+
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = imagev1.AddToScheme(scheme)
+
+	r := &MirrorScheduleReconciler{Client: fake.NewClientBuilder().WithScheme(scheme).Build(), Scheme: scheme}
+
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "nightly"}}
+	if _, err := r.Reconcile(context.Background(), req); err != nil {
+		t.Fatalf("Reconcile: %s", err)
+	}
+
+	if n := testutil.CollectAndCount(mirrorImagesTotal); n != 0 {
+		t.Errorf("%d series left for the deleted MirrorSchedule", n)
+	}
+}
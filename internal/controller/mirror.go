@@ -1,64 +1,106 @@
 package controller
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	apiv1 "github.com/yxwuxuanl/k8s-image-operator/api/v1"
+	"github.com/yxwuxuanl/k8s-image-operator/internal/agent"
+	"github.com/yxwuxuanl/k8s-image-operator/internal/reference"
+	"hash/fnv"
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/rand"
 	"k8s.io/utils/ptr"
 	"slices"
+	"strconv"
 	"strings"
 )
 
-var craneImage = flag.String("crane-image", "", "crane image")
+var mirrorAgentImage = flag.String("mirror-agent-image", "", "image of the mirror pods, the operator image which runs the mirror agent")
 
-func buildMirrorPodTemplate(mirror *apiv1.Mirror) corev1.PodTemplateSpec {
+// workListDir is where the work list of a Mirror is mounted in its pods.
+const workListDir = "/etc/mirror"
+
+// buildMirrorPodTemplate returns the pod template of the Job of mirror,
+// which only runs the images at indexes of the work list when indexes is set.
+func buildMirrorPodTemplate(mirror *apiv1.Mirror, indexes []int) corev1.PodTemplateSpec {
 	volumes := []corev1.Volume{
 		{
-			Name: "data",
+			Name: "work-list",
 			VolumeSource: corev1.VolumeSource{
-				EmptyDir: &corev1.EmptyDirVolumeSource{
-					SizeLimit: mirror.Spec.SizeLimit,
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: workListConfigMapName(mirror),
+					},
 				},
 			},
 		},
 	}
 
-	volumeMounts := []corev1.VolumeMount{
+	mounts := []corev1.VolumeMount{
 		{
-			Name:      "data",
-			MountPath: "/data",
+			Name:      "work-list",
+			MountPath: workListDir,
+			ReadOnly:  true,
 		},
 	}
 
-	if mirror.Spec.DockerConfig != nil {
+	if mirror.Spec.Mode != apiv1.MirrorModeCopy {
 		volumes = append(volumes, corev1.Volume{
-			Name: "dockerconfig",
+			Name: "data",
 			VolumeSource: corev1.VolumeSource{
-				Secret: mirror.Spec.DockerConfig,
+				EmptyDir: &corev1.EmptyDirVolumeSource{
+					SizeLimit: mirror.Spec.SizeLimit,
+				},
 			},
 		})
-		volumeMounts = append(volumeMounts, corev1.VolumeMount{
-			Name:      "dockerconfig",
-			MountPath: "/.docker/config.json",
-			SubPath:   corev1.DockerConfigJsonKey,
+		mounts = append(mounts, corev1.VolumeMount{
+			Name:      "data",
+			MountPath: "/data",
 		})
 	}
 
-	var verbose string
-	if mirror.Spec.Verbose {
-		verbose = "-v"
+	// credentialsMounts mounts the docker config of a stage in dir, each container only gets the credentials of its stage
+	credentialsMounts := func(stage, dir string) []corev1.VolumeMount {
+		return nil
 	}
 
-	pullCmd := []string{
-		"crane",
-		"pull",
-		"\\$SOURCE_${JOB_COMPLETION_INDEX}",
-		"/data/image.tar.gz",
-		"\\$PLATFORM_ARG_${JOB_COMPLETION_INDEX}",
-		verbose,
+	if usesCredentialsSecret(mirror) {
+		volumes = append(volumes, corev1.Volume{
+			Name: "credentials",
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName: credentialsSecretName(mirror),
+				},
+			},
+		})
+		credentialsMounts = func(stage, dir string) []corev1.VolumeMount {
+			return []corev1.VolumeMount{
+				{
+					Name:      "credentials",
+					MountPath: dir + "/config.json",
+					SubPath:   stage,
+				},
+			}
+		}
+	} else if mirror.Spec.DockerConfig != nil {
+		volumes = append(volumes, corev1.Volume{
+			Name: "dockerconfig",
+			VolumeSource: corev1.VolumeSource{
+				Secret: mirror.Spec.DockerConfig,
+			},
+		})
+		credentialsMounts = func(_, dir string) []corev1.VolumeMount {
+			return []corev1.VolumeMount{
+				{
+					Name:      "dockerconfig",
+					MountPath: dir + "/config.json",
+					SubPath:   corev1.DockerConfigJsonKey,
+				},
+			}
+		}
 	}
 
 	securityContext := &corev1.SecurityContext{
@@ -70,64 +112,47 @@ func buildMirrorPodTemplate(mirror *apiv1.Mirror) corev1.PodTemplateSpec {
 		RunAsNonRoot: ptr.To(true),
 	}
 
-	pullContainer := corev1.Container{
-		Name:            "pull",
-		Image:           *craneImage,
-		ImagePullPolicy: corev1.PullIfNotPresent,
-		VolumeMounts:    volumeMounts,
-		SecurityContext: securityContext,
-		Env: []corev1.EnvVar{
-			{
-				Name:  "DOCKER_CONFIG",
-				Value: "/.docker",
-			},
-		},
-		Command: []string{"sh"},
-		Args:    []string{"-c", ptr.To(buildMirrorScript(mirror.Spec.Images, pullCmd)).String()},
-	}
-
-	var pushCmd [][]string
-	pushCmd = append(pushCmd, []string{
-		"crane",
-		"push",
-		"/data/image.tar.gz",
-		"\\$TARGET_${JOB_COMPLETION_INDEX}",
-		"\\$PLATFORM_ARG_${JOB_COMPLETION_INDEX}",
-		verbose,
-	})
-
-	if mirror.Spec.SetSourceAnnotation {
-		pushCmd = append(pushCmd, []string{
-			"crane",
-			"mutate",
-			"-a",
-			"mirror-source=\\$SOURCE_${JOB_COMPLETION_INDEX}",
-			"\\$TARGET_${JOB_COMPLETION_INDEX}",
-			verbose,
-		})
-	}
+	// newContainer returns a container running stage of the mirror agent,
+	// with the credentials of the source in /.docker/source and of the targets in /.docker/target.
+	newContainer := func(stage string, source, target bool) corev1.Container {
+		args := []string{
+			"mirror-agent",
+			stage,
+			"--work-list=" + workListDir + "/" + agent.WorkListKey,
+			"--source-docker-config=/.docker/source",
+			"--target-docker-config=/.docker/target",
+		}
 
-	pushContainer := corev1.Container{
-		Name:            "push",
-		Image:           *craneImage,
-		ImagePullPolicy: corev1.PullIfNotPresent,
-		SecurityContext: securityContext,
-		VolumeMounts:    volumeMounts,
-		Command:         []string{"sh"},
-		Env: []corev1.EnvVar{
-			{
-				Name:  "DOCKER_CONFIG",
-				Value: "/.docker",
-			},
-		},
-		Args: []string{
-			"-c",
-			ptr.To(buildMirrorScript(mirror.Spec.Images, pushCmd...)).String(),
-		},
+		if len(indexes) > 0 {
+			args = append(args, "--indexes="+joinIndexes(indexes))
+		}
+
+		if mirror.Spec.Verbose {
+			args = append(args, "--verbose")
+		}
+
+		var credentials []corev1.VolumeMount
+		if source {
+			credentials = append(credentials, credentialsMounts(sourceCredentialsKey, "/.docker/source")...)
+		}
+		if target {
+			credentials = append(credentials, credentialsMounts(targetCredentialsKey, "/.docker/target")...)
+		}
+
+		return corev1.Container{
+			Name:            stage,
+			Image:           *mirrorAgentImage,
+			ImagePullPolicy: corev1.PullIfNotPresent,
+			VolumeMounts:    slices.Concat(mounts, credentials),
+			SecurityContext: securityContext,
+			Command:         []string{"/manager"},
+			Args:            args,
+		}
 	}
 
+	var httpProxyEnvs []corev1.EnvVar
 	if proxy := mirror.Spec.HttpProxy; proxy != "" {
-		httpProxyEnvs := []corev1.EnvVar{
+		httpProxyEnvs = []corev1.EnvVar{
 			{
 				Name:  "HTTP_PROXY",
 				Value: proxy,
@@ -137,101 +162,326 @@ func buildMirrorPodTemplate(mirror *apiv1.Mirror) corev1.PodTemplateSpec {
 				Value: proxy,
 			},
 		}
+	}
+
+	// a container that talks to both registries bypasses the proxy for the targets instead
+	bothRegistriesEnvs := httpProxyEnvs
+	if len(httpProxyEnvs) > 0 && !mirror.Spec.PushUseProxy {
+		bothRegistriesEnvs = append(slices.Clone(httpProxyEnvs), corev1.EnvVar{
+			Name:  "NO_PROXY",
+			Value: strings.Join(targetRegistries(mirror.Spec.Images), ","),
+		})
+	}
+
+	podSpec := corev1.PodSpec{
+		Volumes:                      volumes,
+		NodeSelector:                 mirror.Spec.NodeSelector,
+		RestartPolicy:                corev1.RestartPolicyNever,
+		ActiveDeadlineSeconds:        mirror.Spec.ActiveDeadlineSeconds,
+		EnableServiceLinks:           ptr.To(false),
+		AutomountServiceAccountToken: ptr.To(false),
+		Tolerations:                  mirror.Spec.Tolerations,
+	}
 
-		pullContainer.Env = append(pullContainer.Env, httpProxyEnvs...)
-		if mirror.Spec.PushUseProxy {
-			pushContainer.Env = append(pushContainer.Env, httpProxyEnvs...)
+	if mirror.Spec.Mode == apiv1.MirrorModeCopy {
+		// the copy streams the blobs from the source to the targets, so nothing is written to disk.
+		copyContainer := newContainer(agent.StageCopy, true, true)
+		copyContainer.Env = bothRegistriesEnvs
+
+		podSpec.Containers = []corev1.Container{copyContainer}
+	} else {
+		// the check reads the digest of the source and skips the targets that are up to date,
+		// reading both digests needs both credentials, which the pull and push containers don't get
+		checkContainer := newContainer(agent.StageCheck, true, true)
+		checkContainer.Env = bothRegistriesEnvs
+
+		// the source is pulled once and pushed to every target
+		pullContainer := newContainer(agent.StagePull, true, false)
+		pullContainer.Env = httpProxyEnvs
+
+		// the referrers are read from the source by the push
+		copyReferrers := slices.ContainsFunc(mirror.Spec.Images, func(image apiv1.MirrorImage) bool {
+			return image.CopyReferrers
+		})
+
+		pushContainer := newContainer(agent.StagePush, copyReferrers, true)
+		if copyReferrers {
+			pushContainer.Env = bothRegistriesEnvs
+		} else if mirror.Spec.PushUseProxy {
+			pushContainer.Env = httpProxyEnvs
 		}
+
+		podSpec.InitContainers = []corev1.Container{checkContainer, pullContainer}
+		podSpec.Containers = []corev1.Container{pushContainer}
+	}
+
+	annotations := map[string]string{
+		MirrorAnnotation: mirror.GetName(),
+	}
+
+	if len(indexes) > 0 {
+		annotations[MirrorIndexesAnnotation] = joinIndexes(indexes)
 	}
 
 	return corev1.PodTemplateSpec{
 		ObjectMeta: metav1.ObjectMeta{
-			Annotations: map[string]string{
-				MirrorAnnotation: mirror.GetName(),
-			},
+			Annotations: annotations,
+		},
+		Spec: podSpec,
+	}
+}
+
+// workListConfigMapName returns the name of the ConfigMap with the work list of mirror, which ends with
+// a hash of the list: the ConfigMap is immutable, tags resolved again after a failed Job creation get their own.
+func workListConfigMapName(mirror *apiv1.Mirror) string {
+	// a work list of strings and bools always marshals
+	data, _ := json.Marshal(buildWorkList(mirror))
+
+	hash := fnv.New32a()
+	hash.Write(data)
+
+	return mirror.Name + "-work-list-" + rand.SafeEncodeString(strconv.FormatUint(uint64(hash.Sum32()), 10))
+}
+
+// buildWorkList returns the work list of mirror, an image per Job index.
+func buildWorkList(mirror *apiv1.Mirror) agent.WorkList {
+	workList := agent.WorkList{
+		SetSourceAnnotation: mirror.Spec.SetSourceAnnotation,
+	}
+
+	for _, image := range toMirrorImage(mirrorImages(mirror)) {
+		workList.Images = append(workList.Images, agent.Image{
+			Source:        image.source,
+			Targets:       image.targets,
+			Platforms:     image.platforms,
+			PreserveIndex: image.preserveIndex,
+			CopyReferrers: image.copyReferrers,
+		})
+	}
+
+	return workList
+}
+
+// buildWorkListConfigMap returns the ConfigMap with the work list of mirror.
+// The images are passed to the agent as data, so nothing of the spec ends up in a command line.
+func buildWorkListConfigMap(mirror *apiv1.Mirror) (*corev1.ConfigMap, error) {
+	data, err := json.Marshal(buildWorkList(mirror))
+	if err != nil {
+		return nil, err
+	}
+
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      workListConfigMapName(mirror),
+			Namespace: mirror.Namespace,
 		},
-		Spec: corev1.PodSpec{
-			Volumes:                      volumes,
-			InitContainers:               []corev1.Container{pullContainer},
-			Containers:                   []corev1.Container{pushContainer},
-			NodeSelector:                 mirror.Spec.NodeSelector,
-			RestartPolicy:                corev1.RestartPolicyNever,
-			ActiveDeadlineSeconds:        mirror.Spec.ActiveDeadlineSeconds,
-			EnableServiceLinks:           ptr.To(false),
-			AutomountServiceAccountToken: ptr.To(false),
-			Tolerations:                  mirror.Spec.Tolerations,
+		Immutable: ptr.To(true),
+		Data: map[string]string{
+			agent.WorkListKey: string(data),
 		},
+	}, nil
+}
+
+// targetRegistries returns the distinct registries images are pushed to.
+func targetRegistries(images []apiv1.MirrorImage) []string {
+	var registries []string
+	for _, image := range images {
+		for _, target := range image.AllTargets() {
+			ref, err := reference.ParseNormalized(target)
+			if err != nil {
+				continue
+			}
+
+			if !slices.Contains(registries, ref.Hostname()) {
+				registries = append(registries, ref.Hostname())
+			}
+		}
 	}
+
+	return registries
 }
 
-func buildMirrorJob(mirror *apiv1.Mirror) *batchv1.Job {
-	return &batchv1.Job{
+// buildMirrorJob returns the Job of mirror, with an index per image, or only the images at indexes when retrying.
+func buildMirrorJob(mirror *apiv1.Mirror, indexes []int) *batchv1.Job {
+	completions := int32(len(toMirrorImage(mirrorImages(mirror))))
+	if len(indexes) > 0 {
+		completions = int32(len(indexes))
+	}
+
+	parallelism := mirror.Spec.Parallelism
+	if parallelism == 0 {
+		parallelism = min(apiv1.DefaultMirrorParallelism, completions)
+	}
+
+	job := &batchv1.Job{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      mirror.GetName(),
+			Name:      mirrorJobName(mirror),
 			Namespace: mirror.GetNamespace(),
 		},
 		Spec: batchv1.JobSpec{
 			BackoffLimit:   ptr.To(int32(0)),
-			Parallelism:    ptr.To(mirror.Spec.Parallelism),
-			Completions:    ptr.To(int32(len(toMirrorImage(mirror.Spec.Images)))),
+			Parallelism:    ptr.To(min(parallelism, completions)),
+			Completions:    ptr.To(completions),
 			CompletionMode: ptr.To(batchv1.IndexedCompletion),
-			Template:       buildMirrorPodTemplate(mirror),
+			Template:       buildMirrorPodTemplate(mirror, indexes),
 		},
 	}
+
+	if len(indexes) > 0 {
+		job.Annotations = map[string]string{
+			MirrorIndexesAnnotation: joinIndexes(indexes),
+		}
+	}
+
+	if limit := mirror.Spec.BackoffLimitPerIndex; limit != nil {
+		// a failed image doesn't fail the Job, the limit of the Job is left to its default
+		job.Spec.BackoffLimit = nil
+		job.Spec.BackoffLimitPerIndex = ptr.To(*limit)
+		job.Spec.PodFailurePolicy = &batchv1.PodFailurePolicy{
+			Rules: []batchv1.PodFailurePolicyRule{
+				{
+					// the agent already retried the transient errors, the others won't go away
+					Action: batchv1.PodFailurePolicyActionFailIndex,
+					OnExitCodes: &batchv1.PodFailurePolicyOnExitCodesRequirement{
+						Operator: batchv1.PodFailurePolicyOnExitCodesOpIn,
+						Values:   []int32{agent.ExitCodePermanent},
+					},
+				},
+				{
+					// evicted or preempted pods don't count against the limit
+					Action: batchv1.PodFailurePolicyActionIgnore,
+					OnPodConditions: []batchv1.PodFailurePolicyOnPodConditionsPattern{
+						{
+							Type:   corev1.DisruptionTarget,
+							Status: corev1.ConditionTrue,
+						},
+					},
+				},
+			},
+		}
+	}
+
+	return job
 }
 
-type mirrorImage struct {
-	source, target string
-	platforms      []string
+// mirrorJobName returns the name of the current Job of mirror, the first one or the Job of its last retry.
+func mirrorJobName(mirror *apiv1.Mirror) string {
+	if mirror.Status.Retries == 0 {
+		return mirror.GetName()
+	}
+
+	return fmt.Sprintf("%s-retry-%d", mirror.GetName(), mirror.Status.Retries)
 }
 
-func toMirrorImage(images []apiv1.MirrorImage) []mirrorImage {
-	var result []mirrorImage
-	for _, image := range images {
-		if len(image.Tags) == 0 {
-			result = append(result, mirrorImage{
-				source:    image.Source,
-				target:    image.Target,
-				platforms: image.Platforms,
-			})
+func joinIndexes(indexes []int) string {
+	list := make([]string, 0, len(indexes))
+	for _, index := range indexes {
+		list = append(list, strconv.Itoa(index))
+	}
+
+	return strings.Join(list, ",")
+}
+
+// countIndexes returns how many indexes are in the ranges of the failedIndexes of a Job, e.g. 1,3-5.
+func countIndexes(s string) int32 {
+	var count int32
+	for _, r := range strings.Split(s, ",") {
+		if r == "" {
 			continue
 		}
 
-		for _, tag := range image.Tags {
-			result = append(result, mirrorImage{
-				source:    fmt.Sprintf("%s:%s", image.Source, tag),
-				target:    fmt.Sprintf("%s:%s", image.Target, tag),
-				platforms: image.Platforms,
-			})
+		first, last, ok := strings.Cut(r, "-")
+		if !ok {
+			count++
+			continue
+		}
+
+		from, err1 := strconv.Atoi(first)
+		to, err2 := strconv.Atoi(last)
+		if err1 == nil && err2 == nil && to >= from {
+			count += int32(to - from + 1)
 		}
 	}
 
-	return result
+	return count
 }
 
-func buildMirrorScript(images []apiv1.MirrorImage, cmds ...[]string) strings.Builder {
-	var bld strings.Builder
-
-	for i, image := range toMirrorImage(images) {
-		var platforms []string
-		for _, platform := range image.platforms {
-			platforms = append(platforms, "--platform", platform)
+// parseIndexes parses the indexes of MirrorIndexesAnnotation.
+func parseIndexes(s string) ([]int, error) {
+	var indexes []int
+	for _, v := range strings.Split(s, ",") {
+		index, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
 		}
 
-		bld.WriteString(fmt.Sprintf(`PLATFORM_ARG_%d="%s"`+"\n", i, strings.Join(platforms, " ")))
-		bld.WriteString(fmt.Sprintf("SOURCE_%d=%s\n", i, image.source))
-		bld.WriteString(fmt.Sprintf("TARGET_%d=%s\n", i, image.target))
+		indexes = append(indexes, index)
 	}
 
-	bld.WriteString("set -ex\n")
+	return indexes, nil
+}
+
+// mirrorImage is the image copied by a Job index, from source to every target.
+type mirrorImage struct {
+	source        string
+	targets       []string
+	platforms     []string
+	preserveIndex bool
+	copyReferrers bool
+
+	// status is the index of the status of the first target in the status of the Mirror,
+	// the status of every (source, target) pair has its own entry.
+	status int
+}
 
-	for _, cmd := range cmds {
-		cmd = slices.DeleteFunc(cmd, func(s string) bool {
-			return len(s) == 0
+func toMirrorImage(images []apiv1.MirrorImage) []mirrorImage {
+	var (
+		result []mirrorImage
+		status int
+	)
+
+	add := func(image apiv1.MirrorImage, source string, targets []string) {
+		result = append(result, mirrorImage{
+			source:        source,
+			targets:       targets,
+			platforms:     image.Platforms,
+			preserveIndex: image.PreserveIndex,
+			copyReferrers: image.CopyReferrers,
+			status:        status,
 		})
+		status += len(targets)
+	}
+
+	for _, image := range images {
+		if len(image.Tags) == 0 {
+			// nothing matched the selector, the tag of the source is not what was asked for
+			if image.TagSelector != nil {
+				continue
+			}
+
+			add(image, image.Source, image.AllTargets())
+			continue
+		}
+
+		for _, tag := range image.Tags {
+			var targets []string
+			for _, target := range image.AllTargets() {
+				targets = append(targets, withTag(target, tag))
+			}
+
+			add(image, withTag(image.Source, tag), targets)
+		}
+	}
+
+	return result
+}
 
-		bld.WriteString(`eval "` + strings.Join(cmd, " ") + `"` + "\n")
+// withTag replaces the tag of image, references are validated by the webhook.
+func withTag(image, tag string) string {
+	ref, err := reference.Parse(image)
+	if err != nil {
+		return fmt.Sprintf("%s:%s", image, tag)
 	}
 
-	return bld
+	return ref.WithTag(tag).String()
 }
@@ -24,9 +24,11 @@ import (
 	"gomodules.xyz/jsonpatch/v2"
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/retry"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/event"
@@ -43,21 +45,37 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/log"
 
 	imagev1 "github.com/yxwuxuanl/k8s-image-operator/api/v1"
+	"github.com/yxwuxuanl/k8s-image-operator/internal/reference"
 )
 
 var (
-	cleanFinishedMirrorDuration = flag.Duration("clean-finished-mirror", time.Hour, "clean finished mirror")
+	cleanFinishedMirrorDuration = flag.Duration("clean-finished-mirror", time.Hour, "default time to keep a finished mirror, overridden by its ttlSecondsAfterFinished, 0 keeps it forever")
 )
 
 // MirrorReconciler reconciles a Mirror object
 type MirrorReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+
+	resolver *digestResolver
 }
 
 const (
 	JobCreated       = "JobCreated"
 	MirrorAnnotation = "image.lin2ur.cn/mirror"
+
+	// mirrorOwnerKey indexes Mirrors by their owner, see mirrorOwner.
+	mirrorOwnerKey = ".metadata.controller"
+
+	// ImageSkipped is the phase of an image that was already present at the target with the same digest.
+	ImageSkipped = "Skipped"
+
+	// RetryFailedAnnotation on a finished Mirror starts a Job that mirrors its failed images again.
+	RetryFailedAnnotation = "image.lin2ur.cn/retry-failed"
+	// MirrorIndexesAnnotation is set on the Job of a retry and its pods to the indexes of the images it runs,
+	// by completion index.
+	MirrorIndexesAnnotation = "image.lin2ur.cn/indexes"
 )
 
 //+kubebuilder:rbac:groups=image.lin2ur.cn,resources=mirrors,verbs=get;list;watch;create;update;patch;delete
@@ -65,6 +83,8 @@ const (
 //+kubebuilder:rbac:groups=image.lin2ur.cn,resources=mirrors/finalizers,verbs=update;watch
 //+kubebuilder:rbac:groups=batch,resources=jobs,verbs=create;list;get;watch
 //+kubebuilder:rbac:groups=core,resources=pods,verbs=list;get;watch
+//+kubebuilder:rbac:groups=core,resources=secrets,verbs=create
+//+kubebuilder:rbac:groups=core,resources=configmaps,verbs=create
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -78,53 +98,81 @@ const (
 func (r *MirrorReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	logger := log.FromContext(ctx)
 
-	if strings.HasSuffix(req.Name, "-job") {
-		req.Name = strings.TrimSuffix(req.Name, "-job")
-		if err := r.syncJobStatus(ctx, req); err != nil {
-			logger.Error(err, "unable to sync job status")
+	mirror := &imagev1.Mirror{}
+	if err := r.Get(ctx, req.NamespacedName, mirror); err != nil {
+		// whoever deleted the Mirror, its series must not be exported forever
+		if errors.IsNotFound(err) {
+			deleteMirrorMetrics(req.Namespace, req.Name)
+			return ctrl.Result{}, nil
 		}
-		return ctrl.Result{}, nil
-	}
 
-	if strings.HasSuffix(req.Name, "-pod") {
-		req.Name = strings.TrimSuffix(req.Name, "-pod")
-		if err := r.syncPodStatus(ctx, req); err != nil {
-			logger.Error(err, "unable to sync pod status")
-		}
-		return ctrl.Result{}, nil
+		logger.Error(err, "unable to fetch mirror")
+		return ctrl.Result{}, err
 	}
 
-	mirror := &imagev1.Mirror{}
-	if err := r.Get(ctx, req.NamespacedName, mirror); err != nil {
-		logger.Error(err, "unable to fetch mirror")
-		return ctrl.Result{}, client.IgnoreNotFound(err)
+	if _, ok := mirror.GetAnnotations()[RetryFailedAnnotation]; ok {
+		return ctrl.Result{}, r.retryFailed(ctx, mirror)
 	}
 
-	job := buildMirrorJob(mirror)
-	_ = ctrl.SetControllerReference(mirror, job, r.Scheme)
+	// the Job is created once, a requeued Mirror whose Job exists has nothing left to do
+	if cond := meta.FindStatusCondition(mirror.Status.Conditions, JobCreated); cond != nil && cond.Status == metav1.ConditionTrue {
+		return ctrl.Result{}, nil
+	}
 
 	var condition metav1.Condition
 	condition.Type = JobCreated
 	condition.LastTransitionTime = metav1.NewTime(time.Now())
 
-	err := r.Create(ctx, job)
+	credentials, err := loadMirrorCredentials(ctx, r.resolver.reader, mirror)
+	if err != nil {
+		return ctrl.Result{}, r.setJobCreateFailed(ctx, mirror, "CredentialsInvalid", err)
+	}
+
+	// the Job is sized by the resolved tags, so they are resolved first
+	if err := r.resolveTags(ctx, mirror, credentials); err != nil {
+		return ctrl.Result{}, r.setJobCreateFailed(ctx, mirror, "TagResolveFailed", err)
+	}
+
+	if usesCredentialsSecret(mirror) {
+		if err := r.createCredentialsSecret(ctx, mirror, credentials); err != nil {
+			return ctrl.Result{}, r.setJobCreateFailed(ctx, mirror, "CredentialsSecretCreateFailed", err)
+		}
+	}
+
+	if err := r.createWorkListConfigMap(ctx, mirror); err != nil {
+		return ctrl.Result{}, r.setJobCreateFailed(ctx, mirror, "WorkListCreateFailed", err)
+	}
+
+	job := buildMirrorJob(mirror, nil)
+	_ = ctrl.SetControllerReference(mirror, job, r.Scheme)
+
+	// a reconcile that failed to record the Job it created finds it
+	if err = r.Create(ctx, job); errors.IsAlreadyExists(err) {
+		err = nil
+	}
 
 	if err != nil {
 		condition.Status = metav1.ConditionFalse
 		condition.Reason = "JobCreateFailed"
 		condition.Message = err.Error()
+
+		r.Recorder.Eventf(mirror, corev1.EventTypeWarning, "JobCreateFailed", "Failed to create Job %s: %s", job.Name, err)
 	} else {
 		condition.Status = metav1.ConditionTrue
 		condition.Reason = "JobCreated"
 		condition.Message = "Job created successfully"
 
-		for _, image := range toMirrorImage(mirror.Spec.Images) {
-			mirror.Status.Images = append(mirror.Status.Images, imagev1.ImageStatus{
-				Source:             image.source,
-				Target:             image.target,
-				Phase:              "Pending",
-				LastTransitionTime: metav1.NewTime(time.Now()),
-			})
+		r.Recorder.Eventf(mirror, corev1.EventTypeNormal, "JobCreated", "Created Job %s to mirror %d images", job.Name, *job.Spec.Completions)
+
+		for _, image := range toMirrorImage(mirrorImages(mirror)) {
+			for _, target := range image.targets {
+				mirror.Status.Images = append(mirror.Status.Images, imagev1.ImageStatus{
+					Source:             image.source,
+					Target:             target,
+					Phase:              "Pending",
+					LastTransitionTime: metav1.NewTime(time.Now()),
+				})
+			}
 		}
 	}
 
@@ -137,21 +185,224 @@ func (r *MirrorReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 	return ctrl.Result{}, err
 }
 
+// reconcileJob syncs the status of the Mirror owning the Job of req.
+func (r *MirrorReconciler) reconcileJob(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	if err := r.syncJobStatus(ctx, req); err != nil {
+		log.FromContext(ctx).Error(err, "unable to sync job status")
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// reconcilePod syncs the status of the image the mirror pod of req copies.
+func (r *MirrorReconciler) reconcilePod(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	if err := r.syncPodStatus(ctx, req); err != nil {
+		log.FromContext(ctx).Error(err, "unable to sync pod status")
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// setJobCreateFailed records in the status of mirror that its Job could not be created, and returns err.
+func (r *MirrorReconciler) setJobCreateFailed(ctx context.Context, mirror *imagev1.Mirror, reason string, err error) error {
+	meta.SetStatusCondition(&mirror.Status.Conditions, metav1.Condition{
+		Type:               JobCreated,
+		Status:             metav1.ConditionFalse,
+		Reason:             reason,
+		Message:            err.Error(),
+		LastTransitionTime: metav1.NewTime(time.Now()),
+	})
+
+	r.Recorder.Eventf(mirror, corev1.EventTypeWarning, reason, "Failed to create Job: %s", err)
+
+	_ = retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		return r.Status().Update(ctx, mirror)
+	})
+
+	return err
+}
+
+// createCredentialsSecret creates the Secret with the docker configs mounted by the containers of mirror.
+func (r *MirrorReconciler) createCredentialsSecret(ctx context.Context, mirror *imagev1.Mirror, credentials *mirrorCredentials) error {
+	secret := buildCredentialsSecret(mirror, credentials)
+	if err := ctrl.SetControllerReference(mirror, secret, r.Scheme); err != nil {
+		return err
+	}
+
+	if err := r.Create(ctx, secret); err != nil && !errors.IsAlreadyExists(err) {
+		return err
+	}
+
+	return nil
+}
+
+// createWorkListConfigMap creates the ConfigMap with the images the pods of mirror copy.
+func (r *MirrorReconciler) createWorkListConfigMap(ctx context.Context, mirror *imagev1.Mirror) error {
+	configMap, err := buildWorkListConfigMap(mirror)
+	if err != nil {
+		return err
+	}
+
+	if err := ctrl.SetControllerReference(mirror, configMap, r.Scheme); err != nil {
+		return err
+	}
+
+	if err := r.Create(ctx, configMap); err != nil && !errors.IsAlreadyExists(err) {
+		return err
+	}
+
+	return nil
+}
+
+// retryFailed starts a Job that mirrors the images of mirror that didn't succeed again, once its Job finished.
+// The statuses of those images are reset, the others are kept.
+//
+// The Job is named after the retry it runs, and the annotation is only removed once the retry is recorded
+// in the status, so a reconcile failing halfway runs it again and finds the same Job.
+func (r *MirrorReconciler) retryFailed(ctx context.Context, mirror *imagev1.Mirror) error {
+	if finished, _ := mirrorFinished(mirror); finished != "JobComplete" && finished != "JobFailed" {
+		r.Recorder.Eventf(mirror, corev1.EventTypeWarning, "RetryIgnored", "Failed images can only be retried once the Job of the Mirror finished")
+		return r.removeRetryAnnotation(ctx, mirror)
+	}
+
+	images := toMirrorImage(mirrorImages(mirror))
+	indexes := failedImages(mirror, images)
+
+	if len(indexes) == 0 {
+		r.Recorder.Eventf(mirror, corev1.EventTypeNormal, "NothingToRetry", "Every image was mirrored, nothing to retry")
+		return r.removeRetryAnnotation(ctx, mirror)
+	}
+
+	retries := mirror.Status.Retries + 1
+
+	retried := mirror.DeepCopy()
+	retried.Status.Retries = retries
+
+	job := buildMirrorJob(retried, indexes)
+	_ = ctrl.SetControllerReference(mirror, job, r.Scheme)
+
+	if err := r.Create(ctx, job); err != nil && !errors.IsAlreadyExists(err) {
+		r.Recorder.Eventf(mirror, corev1.EventTypeWarning, "RetryFailed", "Failed to create Job %s: %s", job.Name, err)
+		return err
+	}
+
+	if err := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		if err := r.Get(ctx, client.ObjectKeyFromObject(mirror), mirror); err != nil {
+			return err
+		}
+
+		// recorded by a previous reconcile that failed to remove the annotation
+		if mirror.Status.Retries >= retries {
+			return nil
+		}
+
+		resetRetriedImages(mirror, images, indexes)
+		mirror.Status.Retries = retries
+
+		return r.Status().Update(ctx, mirror)
+	}); err != nil {
+		return fmt.Errorf("unable to record retry %d: %w", retries, err)
+	}
+
+	r.Recorder.Eventf(mirror, corev1.EventTypeNormal, "RetryStarted", "Created Job %s to retry %d images", job.Name, len(indexes))
+
+	return r.removeRetryAnnotation(ctx, mirror)
+}
+
+// failedImages returns the indexes in images of those with a target that wasn't mirrored.
+func failedImages(mirror *imagev1.Mirror, images []mirrorImage) []int {
+	var indexes []int
+	for i, image := range images {
+		for j := range image.targets {
+			if k := image.status + j; k < len(mirror.Status.Images) && !imageMirrored(mirror.Status.Images[k]) {
+				indexes = append(indexes, i)
+				break
+			}
+		}
+	}
+
+	return indexes
+}
+
+// resetRetriedImages resets the statuses of the images at indexes, and the conditions and counts of the previous Job.
+func resetRetriedImages(mirror *imagev1.Mirror, images []mirrorImage, indexes []int) {
+	for _, i := range indexes {
+		for j := range images[i].targets {
+			if k := images[i].status + j; k < len(mirror.Status.Images) {
+				mirror.Status.Images[k] = imagev1.ImageStatus{
+					Source:             mirror.Status.Images[k].Source,
+					Target:             mirror.Status.Images[k].Target,
+					Phase:              "Pending",
+					LastTransitionTime: metav1.NewTime(time.Now()),
+				}
+			}
+		}
+	}
+
+	// the conditions of the previous Job would mark the Mirror finished
+	conditions := mirror.Status.Conditions[:0]
+	for _, condition := range mirror.Status.Conditions {
+		if condition.Type == JobCreated || !strings.HasPrefix(condition.Type, "Job") {
+			conditions = append(conditions, condition)
+		}
+	}
+
+	mirror.Status.Conditions = conditions
+	mirror.Status.Running = 0
+	mirror.Status.Failed = 0
+	mirror.Status.Succeeded = int32(len(images) - len(indexes))
+}
+
+func (r *MirrorReconciler) removeRetryAnnotation(ctx context.Context, mirror *imagev1.Mirror) error {
+	patch := client.MergeFrom(mirror.DeepCopy())
+	delete(mirror.Annotations, RetryFailedAnnotation)
+	return r.Patch(ctx, mirror, patch)
+}
+
+// imageMirrored reports whether the image of status is at the target.
+func imageMirrored(status imagev1.ImageStatus) bool {
+	return status.Phase == string(corev1.PodSucceeded) || status.Phase == ImageSkipped
+}
+
 func (r *MirrorReconciler) syncJobStatus(ctx context.Context, req ctrl.Request) error {
 	job := &batchv1.Job{}
 	if err := r.Get(ctx, req.NamespacedName, job); err != nil {
 		return fmt.Errorf("unable to fetch job: %w", err)
 	}
 
+	owner := metav1.GetControllerOf(job)
+	if owner == nil {
+		return nil
+	}
+
 	mirror := &imagev1.Mirror{}
-	if err := r.Get(ctx, req.NamespacedName, mirror); err != nil {
+	if err := r.Get(ctx, client.ObjectKey{Name: owner.Name, Namespace: job.Namespace}, mirror); err != nil {
 		return fmt.Errorf("unable to fetch mirror: %w", err)
 	}
 
+	// the Jobs that were retried don't own the status anymore
+	if job.Name != mirrorJobName(mirror) {
+		return nil
+	}
+
+	mirrorImagesInFlight.WithLabelValues(mirror.Namespace, mirror.Name).Set(float64(job.Status.Active))
+
 	mirror.Status.Running = job.Status.Active
 	mirror.Status.Failed = job.Status.Failed
 	mirror.Status.Succeeded = job.Status.Succeeded
 
+	// with backoffLimitPerIndex, failed counts the retried pods too
+	if job.Status.FailedIndexes != nil {
+		mirror.Status.Failed = countIndexes(*job.Status.FailedIndexes)
+	}
+
+	// the images a retry doesn't run had succeeded before
+	if v, ok := job.GetAnnotations()[MirrorIndexesAnnotation]; ok {
+		if indexes, err := parseIndexes(v); err == nil {
+			mirror.Status.Succeeded += int32(len(toMirrorImage(mirrorImages(mirror))) - len(indexes))
+		}
+	}
+
 	for _, condition := range job.Status.Conditions {
 		cond := metav1.Condition{
 			Type:               "Job" + string(condition.Type),
@@ -194,6 +445,16 @@ func (r *MirrorReconciler) syncPodStatus(ctx context.Context, req ctrl.Request)
 		return nil
 	}
 
+	// the pods of a retry run the images at the indexes of the annotation
+	if v, ok := pod.GetAnnotations()[MirrorIndexesAnnotation]; ok {
+		indexes, err := parseIndexes(v)
+		if err != nil || index >= len(indexes) {
+			return nil
+		}
+
+		index = indexes[index]
+	}
+
 	mirror := &imagev1.Mirror{}
 	if err := r.Get(ctx, client.ObjectKey{
 		Name:      pod.GetAnnotations()[MirrorAnnotation],
@@ -202,67 +463,251 @@ func (r *MirrorReconciler) syncPodStatus(ctx context.Context, req ctrl.Request)
 		return fmt.Errorf("unable to fetch mirror: %w", err)
 	}
 
-	image := &mirror.Status.Images[index]
-	imageStatus := &imagev1.ImageStatus{
-		Source:             image.Source,
-		Target:             image.Target,
-		Phase:              string(pod.Status.Phase),
-		LastTransitionTime: metav1.NewTime(time.Now()),
-		Message:            pod.Status.Message,
-		Pod:                pod.GetName(),
+	// the pods of the Jobs that were retried don't own the status anymore
+	if jobName := pod.Labels[batchv1.JobNameLabel]; jobName != "" && jobName != mirrorJobName(mirror) {
+		return nil
 	}
 
-	jsonPatches, _ := json.Marshal([]jsonpatch.JsonPatchOperation{
-		jsonpatch.NewOperation("replace", "/status/images/"+strconv.Itoa(index), imageStatus),
-	})
+	images := toMirrorImage(mirrorImages(mirror))
+	if index >= len(images) {
+		return nil
+	}
+
+	mirrorImage := images[index]
+	result := parseMirrorPodResult(pod)
+
+	var completionTime *metav1.Time
+	if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+		completionTime = &metav1.Time{Time: podFinishedAt(pod)}
+	}
+
+	var (
+		jsonPatches []jsonpatch.JsonPatchOperation
+		succeeded   bool
+	)
+
+	// the pod pushes to every target, each (source, target) pair has its own status
+	for j := range mirrorImage.targets {
+		statusIndex := mirrorImage.status + j
+		if statusIndex >= len(mirror.Status.Images) {
+			break
+		}
+
+		image := &mirror.Status.Images[statusIndex]
+
+		// a pod retried by backoffLimitPerIndex replaces the previous one, whose late events are ignored
+		if image.Pod != "" && image.Pod != pod.Name && image.StartTime != nil &&
+			pod.Status.StartTime != nil && pod.Status.StartTime.Before(image.StartTime) {
+			continue
+		}
+
+		phase, message := mirrorTargetPhase(pod, result, j)
+		if phase != image.Phase {
+			recordMirrorImageMetrics(mirror, phase)
+
+			switch phase {
+			case ImageSkipped:
+				r.Recorder.Eventf(mirror, corev1.EventTypeNormal, "ImageUpToDate", "Skipped %s, %s is up to date with digest %s", image.Source, image.Target, result.upToDate[j])
+			case string(corev1.PodSucceeded):
+				succeeded = true
+				r.Recorder.Eventf(mirror, corev1.EventTypeNormal, "ImageMirrored", "Mirrored %s to %s", image.Source, image.Target)
+			case string(corev1.PodFailed):
+				r.Recorder.Eventf(
+					mirror, corev1.EventTypeWarning, "ImageMirrorFailed",
+					"Failed to mirror %s to %s: %s, see pod %s", image.Source, image.Target, message, pod.Name,
+				)
+			}
+		}
+
+		imageStatus := &imagev1.ImageStatus{
+			Source:             image.Source,
+			Target:             image.Target,
+			Phase:              phase,
+			LastTransitionTime: metav1.NewTime(time.Now()),
+			Message:            message,
+			Pod:                pod.GetName(),
+			Platforms:          image.Platforms,
+			Digest:             result.upToDate[j],
+			SourceDigest:       result.sourceDigest,
+			TargetDigest:       image.TargetDigest,
+			Size:               image.Size,
+			Layers:             image.Layers,
+			StartTime:          pod.Status.StartTime,
+			CompletionTime:     completionTime,
+			Referrers:          image.Referrers,
+		}
+
+		if phase == string(corev1.PodFailed) && (result.failedTarget == -1 || result.failedTarget == j) {
+			imageStatus.FailedStage = result.failedStage
+			imageStatus.Output = result.output
+		}
+
+		if (phase == string(corev1.PodSucceeded) || phase == ImageSkipped) && image.Phase != phase {
+			if result.targetDigest != "" {
+				imageStatus.TargetDigest = result.targetDigest
+				imageStatus.Size = result.size
+				imageStatus.Layers = result.layers
+				imageStatus.Platforms = result.platforms
+			}
+
+			if copied, ok := result.referrers[j]; ok {
+				imageStatus.Referrers = &copied
+			}
+		}
+
+		jsonPatches = append(jsonPatches, jsonpatch.NewOperation("replace", "/status/images/"+strconv.Itoa(statusIndex), imageStatus))
+	}
+
+	if succeeded {
+		recordMirrorPodDuration(mirror, pod)
+	}
+
+	patch, _ := json.Marshal(jsonPatches)
 
 	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
-		return r.Status().Patch(ctx, mirror, client.RawPatch(types.JSONPatchType, jsonPatches))
+		return r.Status().Patch(ctx, mirror, client.RawPatch(types.JSONPatchType, patch))
 	})
 }
 
-func (r *MirrorReconciler) cleanFinishedMirror() error {
-	var mirrors imagev1.MirrorList
-	if err := r.List(context.Background(), &mirrors); err != nil {
-		return err
+// mirrorTargetPhase returns the phase of the target at index j of a mirror pod, and a message explaining it.
+// The targets are pushed in order, so when the pod failed on a target the previous ones were mirrored.
+func mirrorTargetPhase(pod *corev1.Pod, result *mirrorPodResult, j int) (string, string) {
+	switch pod.Status.Phase {
+	case corev1.PodSucceeded, corev1.PodFailed:
+	default:
+		return string(pod.Status.Phase), pod.Status.Message
 	}
 
-	for _, mirror := range mirrors.Items {
-		var lastTransitionTime time.Time
+	if _, ok := result.upToDate[j]; ok {
+		return ImageSkipped, "target is up to date"
+	}
 
-		if cond := meta.FindStatusCondition(mirror.Status.Conditions, "JobComplete"); cond != nil && cond.Status == metav1.ConditionTrue {
-			lastTransitionTime = cond.LastTransitionTime.Time
-		} else if cond := meta.FindStatusCondition(mirror.Status.Conditions, "JobFailed"); cond != nil && cond.Status == metav1.ConditionTrue {
-			lastTransitionTime = cond.LastTransitionTime.Time
-		} else {
+	if pod.Status.Phase == corev1.PodSucceeded {
+		return string(corev1.PodSucceeded), ""
+	}
+
+	switch {
+	case result.failedStage == "":
+		// the pod didn't get to report a stage, e.g. it was evicted or exceeded its deadline
+		return string(corev1.PodFailed), pod.Status.Message
+	case result.failedTarget == -1 || result.failedTarget == j:
+		return string(corev1.PodFailed), result.failedStage + " failed"
+	case j < result.failedTarget:
+		return string(corev1.PodSucceeded), ""
+	default:
+		return string(corev1.PodFailed), fmt.Sprintf("not mirrored, target %d failed before", result.failedTarget)
+	}
+}
+
+// resolveTags selects the tags of the images with a tagSelector from the tag list of their source,
+// and records them in the status, which sizes the Job.
+func (r *MirrorReconciler) resolveTags(ctx context.Context, mirror *imagev1.Mirror, credentials *mirrorCredentials) error {
+	var resolved []imagev1.ResolvedTags
+
+	keychain, err := credentials.sourceKeychain()
+	if err != nil {
+		return err
+	}
+
+	for i, image := range mirror.Spec.Images {
+		if image.TagSelector == nil {
 			continue
 		}
 
-		if time.Since(lastTransitionTime) > *cleanFinishedMirrorDuration {
-			if err := r.Delete(context.Background(), &mirror); err != nil {
-				log.Log.Error(
-					err,
-					"unable to delete mirror", "mirror", client.ObjectKeyFromObject(&mirror).String(),
-				)
-				continue
-			}
+		ref, err := reference.ParseNormalized(image.Source)
+		if err != nil {
+			return err
+		}
+
+		tags, err := r.resolver.listTags(ctx, ref, keychain)
+		if err != nil {
+			return err
+		}
 
-			log.Log.Info("mirror deleted", "mirror", client.ObjectKeyFromObject(&mirror).String())
+		selected, err := selectTags(tags, image.TagSelector)
+		if err != nil {
+			return fmt.Errorf("invalid tagSelector of %s: %w", image.Source, err)
 		}
+
+		resolved = append(resolved, imagev1.ResolvedTags{
+			Image: int32(i),
+			Tags:  selected,
+		})
 	}
 
-	return nil
+	if len(resolved) == 0 {
+		return nil
+	}
+
+	mirror.Status.ResolvedTags = resolved
+	return r.Status().Update(ctx, mirror)
+}
+
+// recordMirrorImageMetrics records the result of a (source, target) pair that has just finished.
+func recordMirrorImageMetrics(mirror *imagev1.Mirror, phase string) {
+	switch phase {
+	case string(corev1.PodSucceeded), string(corev1.PodFailed), ImageSkipped:
+		mirrorImagesTotal.WithLabelValues(mirror.Namespace, mirrorMetricsName(mirror), phase).Inc()
+	}
+}
+
+// recordMirrorPodDuration records the duration of a mirror pod that has just succeeded.
+func recordMirrorPodDuration(mirror *imagev1.Mirror, pod *corev1.Pod) {
+	if pod.Status.StartTime == nil {
+		return
+	}
+
+	mirrorCopyDuration.WithLabelValues(mirror.Namespace, mirrorMetricsName(mirror)).Observe(podFinishedAt(pod).Sub(pod.Status.StartTime.Time).Seconds())
+}
+
+// podFinishedAt returns when the last container of a finished pod terminated, or now if it isn't known.
+func podFinishedAt(pod *corev1.Pod) time.Time {
+	var finishedAt time.Time
+	for _, status := range append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...) {
+		if terminated := status.State.Terminated; terminated != nil && terminated.FinishedAt.After(finishedAt) {
+			finishedAt = terminated.FinishedAt.Time
+		}
+	}
+
+	if finishedAt.IsZero() {
+		finishedAt = time.Now()
+	}
+
+	return finishedAt
+}
+
+// mirrorOwner returns the kind and name of the object of this group controlling mirror, or "".
+func mirrorOwner(mirror *imagev1.Mirror) string {
+	owner := metav1.GetControllerOf(mirror)
+	if owner == nil || owner.APIVersion != imagev1.GroupVersion.String() {
+		return ""
+	}
+
+	return owner.Kind + "/" + owner.Name
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *MirrorReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	if *craneImage == "" {
-		return fmt.Errorf("crane-image is required")
+	if *mirrorAgentImage == "" {
+		return fmt.Errorf("mirror-agent-image is required")
+	}
+
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &imagev1.Mirror{}, mirrorOwnerKey, func(object client.Object) []string {
+		if owner := mirrorOwner(object.(*imagev1.Mirror)); owner != "" {
+			return []string{owner}
+		}
+
+		return nil
+	}); err != nil {
+		return err
 	}
 
+	r.resolver = newDigestResolver(mgr.GetAPIReader())
+
 	createPred := builder.WithPredicates(predicate.Funcs{
 		DeleteFunc: func(event event.DeleteEvent) bool {
-			return false
+			// the metrics of the Mirror are deleted
+			return true
 		},
 		CreateFunc: func(createEvent event.CreateEvent) bool {
 			return meta.FindStatusCondition(
@@ -271,7 +716,10 @@ func (r *MirrorReconciler) SetupWithManager(mgr ctrl.Manager) error {
 			) == nil
 		},
 		UpdateFunc: func(updateEvent event.UpdateEvent) bool {
-			return false
+			// a retry is started when the annotation is added
+			_, retryOld := updateEvent.ObjectOld.GetAnnotations()[RetryFailedAnnotation]
+			_, retryNew := updateEvent.ObjectNew.GetAnnotations()[RetryFailedAnnotation]
+			return retryNew && !retryOld
 		},
 		GenericFunc: func(genericEvent event.GenericEvent) bool {
 			return false
@@ -299,7 +747,7 @@ func (r *MirrorReconciler) SetupWithManager(mgr ctrl.Manager) error {
 				return []reconcile.Request{
 					{
 						NamespacedName: client.ObjectKey{
-							Name:      reference.Name + "-job",
+							Name:      object.GetName(),
 							Namespace: object.GetNamespace(),
 						},
 					},
@@ -315,7 +763,7 @@ func (r *MirrorReconciler) SetupWithManager(mgr ctrl.Manager) error {
 				return []reconcile.Request{
 					{
 						NamespacedName: client.ObjectKey{
-							Name:      object.GetName() + "-pod",
+							Name:      object.GetName(),
 							Namespace: object.GetNamespace(),
 						},
 					},
@@ -326,19 +774,30 @@ func (r *MirrorReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		return nil
 	})
 
-	go func() {
-		t := time.NewTicker(time.Minute)
-		for {
-			<-t.C
-			if err := r.cleanFinishedMirror(); err != nil {
-				log.Log.Error(err, "unable to clean finished mirror")
-			}
-		}
-	}()
+	if err := mgr.Add(&mirrorCleaner{
+		Client:   mgr.GetClient(),
+		Recorder: r.Recorder,
+	}); err != nil {
+		return err
+	}
+
+	// the Jobs and pods are reconciled by their own controllers, the requests of a single controller
+	// would not tell a Job or pod from a Mirror of the same name
+	if err := ctrl.NewControllerManagedBy(mgr).
+		Named("mirror_job").
+		Watches(&batchv1.Job{}, jobEnqueueFunc, updatePred).
+		Complete(reconcile.Func(r.reconcileJob)); err != nil {
+		return err
+	}
+
+	if err := ctrl.NewControllerManagedBy(mgr).
+		Named("mirror_pod").
+		Watches(&corev1.Pod{}, podEnqueueFunc, updatePred).
+		Complete(reconcile.Func(r.reconcilePod)); err != nil {
+		return err
+	}
 
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&imagev1.Mirror{}, createPred).
-		Watches(&corev1.Pod{}, podEnqueueFunc, updatePred).
-		Watches(&batchv1.Job{}, jobEnqueueFunc, updatePred).
 		Complete(r)
 }
@@ -0,0 +1,237 @@
+package controller
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	imagev1 "github.com/yxwuxuanl/k8s-image-operator/api/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	"strings"
+	"testing"
+)
+
+func TestRetryFailedConflict(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = imagev1.AddToScheme(scheme)
+
+	mirror := &imagev1.Mirror{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "nginx",
+			Namespace:   "default",
+			Annotations: map[string]string{RetryFailedAnnotation: ""},
+		},
+		Spec: imagev1.MirrorSpec{
+			Images: []imagev1.MirrorImage{
+				{Source: "nginx:1.25", Target: "myregistry/nginx:1.25"},
+				{Source: "redis:7", Target: "myregistry/redis:7"},
+			},
+		},
+		Status: imagev1.MirrorStatus{
+			Conditions: []metav1.Condition{
+				{Type: JobCreated, Status: metav1.ConditionTrue, Reason: "JobCreated"},
+				{Type: "JobFailed", Status: metav1.ConditionTrue, Reason: "BackoffLimitExceeded"},
+			},
+			Images: []imagev1.ImageStatus{
+				{Source: "nginx:1.25", Target: "myregistry/nginx:1.25", Phase: string(corev1.PodSucceeded)},
+				{Source: "redis:7", Target: "myregistry/redis:7", Phase: string(corev1.PodFailed)},
+			},
+			Succeeded: 1,
+			Failed:    1,
+		},
+	}
+
+	// the first status update of the retry conflicts with a write from elsewhere
+	var conflicts int
+	cli := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(mirror.DeepCopy()).
+		WithStatusSubresource(&imagev1.Mirror{}).
+		WithInterceptorFuncs(interceptor.Funcs{
+			SubResourceUpdate: func(ctx context.Context, c client.Client, subResource string, obj client.Object, opts ...client.SubResourceUpdateOption) error {
+				if conflicts == 0 {
+					conflicts++
+
+					current := &imagev1.Mirror{}
+					if err := c.Get(ctx, client.ObjectKeyFromObject(obj), current); err != nil {
+						return err
+					}
+
+					current.Status.Images[0].Message = "updated elsewhere"
+					if err := c.Status().Update(ctx, current); err != nil {
+						return err
+					}
+				}
+
+				return c.SubResource(subResource).Update(ctx, obj, opts...)
+			},
+		}).
+		Build()
+
+	r := &MirrorReconciler{Client: cli, Scheme: scheme, Recorder: record.NewFakeRecorder(10)}
+	ctx := context.Background()
+
+	stale := &imagev1.Mirror{}
+	if err := cli.Get(ctx, client.ObjectKeyFromObject(mirror), stale); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.retryFailed(ctx, stale.DeepCopy()); err != nil {
+		t.Fatalf("retryFailed() error = %v", err)
+	}
+
+	// a reconcile running the retry again finds it recorded
+	if err := r.retryFailed(ctx, stale.DeepCopy()); err != nil {
+		t.Fatalf("retryFailed() again error = %v", err)
+	}
+
+	if conflicts != 1 {
+		t.Fatalf("conflicts = %d, want the status update to conflict once", conflicts)
+	}
+
+	got := &imagev1.Mirror{}
+	if err := cli.Get(ctx, client.ObjectKeyFromObject(mirror), got); err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Status.Retries != 1 {
+		t.Errorf("retries = %d, want 1", got.Status.Retries)
+	}
+
+	if _, ok := got.Annotations[RetryFailedAnnotation]; ok {
+		t.Error("the retry-failed annotation was not removed")
+	}
+
+	if meta.FindStatusCondition(got.Status.Conditions, "JobFailed") != nil {
+		t.Error("the JobFailed condition of the previous Job was kept")
+	}
+
+	if images := got.Status.Images; images[0].Message != "updated elsewhere" || images[0].Phase != string(corev1.PodSucceeded) || images[1].Phase != "Pending" {
+		t.Errorf("images = %+v, want the first kept with the concurrent update and the second pending", images)
+	}
+
+	var jobs batchv1.JobList
+	if err := cli.List(ctx, &jobs); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(jobs.Items) != 1 || jobs.Items[0].Name != "nginx-retry-1" || jobs.Items[0].Annotations[MirrorIndexesAnnotation] != "1" {
+		t.Errorf("jobs = %v, want a single nginx-retry-1 Job of index 1", jobs.Items)
+	}
+}
+
+func TestReconcileDeletedMirrorMetrics(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = imagev1.AddToScheme(scheme)
+
+	// a Mirror named like a Job is still a Mirror to its reconciler
+	mirrorImagesTotal.WithLabelValues("default", "deleted-job", string(corev1.PodSucceeded)).Inc()
+	mirrorImagesInFlight.WithLabelValues("default", "deleted-job").Set(1)
+
+	r := &MirrorReconciler{Client: fake.NewClientBuilder().WithScheme(scheme).Build(), Scheme: scheme, Recorder: record.NewFakeRecorder(10)}
+
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "deleted-job"}}
+	if _, err := r.Reconcile(context.Background(), req); err != nil {
+		t.Fatalf("Reconcile: %s", err)
+	}
+
+	if n := testutil.CollectAndCount(mirrorImagesTotal) + testutil.CollectAndCount(mirrorImagesInFlight); n != 0 {
+		t.Errorf("%d series left for the deleted Mirror", n)
+	}
+}
+
+func TestReconcileExistingJob(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = imagev1.AddToScheme(scheme)
+
+	mirror := &imagev1.Mirror{
+		ObjectMeta: metav1.ObjectMeta{Name: "nginx", Namespace: "default"},
+		Spec: imagev1.MirrorSpec{
+			Images: []imagev1.MirrorImage{{Source: "nginx:1.25", Target: "myregistry/nginx:1.25"}},
+		},
+	}
+
+	// created by a reconcile that failed to record it
+	job := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "nginx", Namespace: "default"}}
+
+	cli := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(mirror.DeepCopy(), job).
+		WithStatusSubresource(&imagev1.Mirror{}).
+		Build()
+
+	recorder := record.NewFakeRecorder(10)
+	r := &MirrorReconciler{Client: cli, Scheme: scheme, Recorder: recorder, resolver: newDigestResolver(cli)}
+
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "nginx"}}
+	if _, err := r.Reconcile(context.Background(), req); err != nil {
+		t.Fatalf("Reconcile: %s", err)
+	}
+
+	got := &imagev1.Mirror{}
+	if err := cli.Get(context.Background(), req.NamespacedName, got); err != nil {
+		t.Fatal(err)
+	}
+
+	if !meta.IsStatusConditionTrue(got.Status.Conditions, JobCreated) {
+		t.Errorf("conditions = %v, want the Job created", got.Status.Conditions)
+	}
+
+	if len(got.Status.Images) != 1 || got.Status.Images[0].Phase != "Pending" {
+		t.Errorf("images = %+v, want the image pending", got.Status.Images)
+	}
+
+	if event := <-recorder.Events; !strings.HasPrefix(event, "Normal JobCreated") {
+		t.Errorf("event = %q, want JobCreated", event)
+	}
+}
+
+func TestWorkListConfigMapName(t *testing.T) {
+	mirror := &imagev1.Mirror{
+		ObjectMeta: metav1.ObjectMeta{Name: "nginx", Namespace: "default"},
+		Spec: imagev1.MirrorSpec{
+			Images: []imagev1.MirrorImage{{
+				Source:      "nginx",
+				Target:      "myregistry/nginx",
+				TagSelector: &imagev1.TagSelector{Latest: ptr.To(int32(1))},
+			}},
+		},
+		Status: imagev1.MirrorStatus{
+			ResolvedTags: []imagev1.ResolvedTags{{Image: 0, Tags: []string{"1.25"}}},
+		},
+	}
+
+	name := workListConfigMapName(mirror)
+	if !strings.HasPrefix(name, "nginx-work-list-") {
+		t.Errorf("workListConfigMapName() = %s, want nginx-work-list-<hash>", name)
+	}
+
+	// the pods mount the ConfigMap that is created
+	configMap, err := buildWorkListConfigMap(mirror)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if volume := buildMirrorPodTemplate(mirror, nil).Spec.Volumes[0]; configMap.Name != name || volume.ConfigMap.Name != name {
+		t.Errorf("ConfigMap %s mounted as %s, want %s", configMap.Name, volume.ConfigMap.Name, name)
+	}
+
+	// the tags resolved again after a failed Job creation don't end up in the immutable ConfigMap of the previous ones
+	mirror.Status.ResolvedTags[0].Tags = []string{"1.26"}
+	if workListConfigMapName(mirror) == name {
+		t.Errorf("workListConfigMapName() = %s for other tags", name)
+	}
+}
@@ -0,0 +1,299 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"github.com/robfig/cron/v3"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	ref "k8s.io/client-go/tools/reference"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sort"
+	"time"
+
+	imagev1 "github.com/yxwuxuanl/k8s-image-operator/api/v1"
+)
+
+// ScheduledTimeAnnotation is set on the Mirrors created by a MirrorSchedule to the time of their run.
+const ScheduledTimeAnnotation = "image.lin2ur.cn/scheduled-at"
+
+// MirrorScheduleReconciler reconciles a MirrorSchedule object
+type MirrorScheduleReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+}
+
+//+kubebuilder:rbac:groups=image.lin2ur.cn,resources=mirrorschedules,verbs=get;list;watch
+//+kubebuilder:rbac:groups=image.lin2ur.cn,resources=mirrorschedules/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=image.lin2ur.cn,resources=mirrorschedules/finalizers,verbs=update
+
+// Reconcile creates a Mirror from the template of the MirrorSchedule when a run is due,
+// and deletes the finished Mirrors that exceed the history limits.
+func (r *MirrorScheduleReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	schedule := &imagev1.MirrorSchedule{}
+	if err := r.Get(ctx, req.NamespacedName, schedule); err != nil {
+		// the series of the images its Mirrors mirrored are removed with it
+		if errors.IsNotFound(err) {
+			deleteMirrorMetrics(req.Namespace, "MirrorSchedule/"+req.Name)
+		}
+
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	var mirrors imagev1.MirrorList
+	if err := r.List(ctx, &mirrors, client.InNamespace(req.Namespace), client.MatchingFields{mirrorOwnerKey: "MirrorSchedule/" + req.Name}); err != nil {
+		return ctrl.Result{}, fmt.Errorf("unable to list mirrors: %w", err)
+	}
+
+	var (
+		active, successful, failed []*imagev1.Mirror
+		lastScheduleTime           time.Time
+		lastSuccessfulTime         time.Time
+	)
+
+	// the Mirrors of past runs may have been deleted by the history limits
+	if t := schedule.Status.LastScheduleTime; t != nil {
+		lastScheduleTime = t.Time
+	}
+
+	for i := range mirrors.Items {
+		mirror := &mirrors.Items[i]
+
+		switch finishedType, finishedAt := mirrorFinished(mirror); finishedType {
+		case "":
+			active = append(active, mirror)
+		case "JobComplete":
+			successful = append(successful, mirror)
+			if finishedAt.After(lastSuccessfulTime) {
+				lastSuccessfulTime = finishedAt
+			}
+		default:
+			failed = append(failed, mirror)
+		}
+
+		if scheduledAt := mirrorScheduledTime(mirror); scheduledAt.After(lastScheduleTime) {
+			lastScheduleTime = scheduledAt
+		}
+	}
+
+	r.deleteHistory(ctx, schedule, successful, schedule.Spec.SuccessfulHistoryLimit)
+	r.deleteHistory(ctx, schedule, failed, schedule.Spec.FailedHistoryLimit)
+
+	result, err := r.run(ctx, schedule, lastScheduleTime, &active)
+	if err != nil {
+		logger.Error(err, "unable to run mirror schedule")
+	}
+
+	schedule.Status.Active = nil
+	for _, mirror := range active {
+		mirrorRef, err := ref.GetReference(r.Scheme, mirror)
+		if err != nil {
+			continue
+		}
+
+		schedule.Status.Active = append(schedule.Status.Active, *mirrorRef)
+	}
+
+	if lastScheduleTime, ok := maxScheduledTime(active, lastScheduleTime); ok {
+		schedule.Status.LastScheduleTime = &metav1.Time{Time: lastScheduleTime}
+	}
+
+	if !lastSuccessfulTime.IsZero() {
+		schedule.Status.LastSuccessfulTime = &metav1.Time{Time: lastSuccessfulTime}
+	}
+
+	if err := r.Status().Update(ctx, schedule); err != nil {
+		return ctrl.Result{}, fmt.Errorf("unable to update mirror schedule status: %w", err)
+	}
+
+	return result, err
+}
+
+// run creates the Mirror of the latest missed run, if any, and returns when to reconcile for the next run.
+// The created Mirror is appended to active, and the Mirrors replaced by it are removed.
+func (r *MirrorScheduleReconciler) run(
+	ctx context.Context,
+	schedule *imagev1.MirrorSchedule,
+	lastScheduleTime time.Time,
+	active *[]*imagev1.Mirror,
+) (ctrl.Result, error) {
+	if schedule.Spec.Suspend {
+		return ctrl.Result{}, nil
+	}
+
+	sched, err := cron.ParseStandard(schedule.Spec.Schedule)
+	if err != nil {
+		r.Recorder.Eventf(schedule, corev1.EventTypeWarning, "InvalidSchedule", "Unable to parse schedule %q: %s", schedule.Spec.Schedule, err)
+		return ctrl.Result{}, nil
+	}
+
+	now := time.Now()
+	missedRun, nextRun := nextSchedule(schedule, sched, lastScheduleTime, now)
+	result := ctrl.Result{RequeueAfter: nextRun.Sub(now)}
+
+	if missedRun.IsZero() {
+		return result, nil
+	}
+
+	switch schedule.Spec.ConcurrencyPolicy {
+	case imagev1.ForbidConcurrent:
+		if len(*active) > 0 {
+			r.Recorder.Eventf(schedule, corev1.EventTypeNormal, "SkippedSchedule", "Skipped the run of %s, %d Mirrors are still running", missedRun.Format(time.RFC3339), len(*active))
+			return result, nil
+		}
+	case imagev1.ReplaceConcurrent:
+		for _, mirror := range *active {
+			if err := r.Delete(ctx, mirror, client.PropagationPolicy(metav1.DeletePropagationBackground)); client.IgnoreNotFound(err) != nil {
+				return result, fmt.Errorf("unable to delete active mirror %s: %w", mirror.Name, err)
+			}
+
+			r.Recorder.Eventf(schedule, corev1.EventTypeNormal, "MirrorReplaced", "Deleted running Mirror %s", mirror.Name)
+		}
+
+		*active = nil
+	}
+
+	mirror := &imagev1.Mirror{
+		ObjectMeta: metav1.ObjectMeta{
+			// minutes are enough, cron can't schedule more often
+			Name:      fmt.Sprintf("%s-%d", schedule.Name, missedRun.Unix()/60),
+			Namespace: schedule.Namespace,
+			Annotations: map[string]string{
+				ScheduledTimeAnnotation: missedRun.Format(time.RFC3339),
+			},
+		},
+		Spec: *schedule.Spec.Template.DeepCopy(),
+	}
+
+	// templates created before parallelism was bounded by the webhook have the old default of 5
+	if count, ok := mirror.Spec.ImageCount(); ok && mirror.Spec.Parallelism > count {
+		mirror.Spec.Parallelism = count
+	}
+
+	if err := ctrl.SetControllerReference(schedule, mirror, r.Scheme); err != nil {
+		return result, err
+	}
+
+	if err := r.Create(ctx, mirror); err != nil {
+		if errors.IsAlreadyExists(err) {
+			return result, nil
+		}
+
+		r.Recorder.Eventf(schedule, corev1.EventTypeWarning, "MirrorCreateFailed", "Failed to create Mirror %s: %s", mirror.Name, err)
+		return result, fmt.Errorf("unable to create mirror: %w", err)
+	}
+
+	r.Recorder.Eventf(schedule, corev1.EventTypeNormal, "MirrorCreated", "Created Mirror %s", mirror.Name)
+	*active = append(*active, mirror)
+
+	return result, nil
+}
+
+// deleteHistory deletes the oldest finished Mirrors beyond limit, a nil limit keeps all of them.
+func (r *MirrorScheduleReconciler) deleteHistory(ctx context.Context, schedule *imagev1.MirrorSchedule, mirrors []*imagev1.Mirror, limit *int32) {
+	if limit == nil || len(mirrors) <= int(*limit) {
+		return
+	}
+
+	sort.Slice(mirrors, func(i, j int) bool {
+		return mirrorScheduledTime(mirrors[i]).Before(mirrorScheduledTime(mirrors[j]))
+	})
+
+	for _, mirror := range mirrors[:len(mirrors)-int(*limit)] {
+		if err := r.Delete(ctx, mirror, client.PropagationPolicy(metav1.DeletePropagationBackground)); client.IgnoreNotFound(err) != nil {
+			log.FromContext(ctx).Error(err, "unable to delete old mirror", "mirror", mirror.Name)
+			continue
+		}
+
+		r.Recorder.Eventf(schedule, corev1.EventTypeNormal, "MirrorDeleted", "Deleted finished Mirror %s", mirror.Name)
+	}
+}
+
+// nextSchedule returns the latest run due since the last one, or the zero time, and the next run.
+func nextSchedule(schedule *imagev1.MirrorSchedule, sched cron.Schedule, lastScheduleTime, now time.Time) (time.Time, time.Time) {
+	earliest := lastScheduleTime
+	if earliest.IsZero() {
+		earliest = schedule.CreationTimestamp.Time
+	}
+
+	if deadline := schedule.Spec.StartingDeadlineSeconds; deadline != nil {
+		// runs before the deadline can't be started anyway
+		if start := now.Add(-time.Duration(*deadline) * time.Second); start.After(earliest) {
+			earliest = start
+		}
+	}
+
+	var missedRun time.Time
+	for t := sched.Next(earliest); !t.After(now); t = sched.Next(t) {
+		missedRun = t
+	}
+
+	return missedRun, sched.Next(now)
+}
+
+// mirrorFinished returns the type of the condition that finished the Mirror and when, or "" if it is still running.
+func mirrorFinished(mirror *imagev1.Mirror) (string, time.Time) {
+	for _, condType := range []string{"JobComplete", "JobFailed"} {
+		if cond := meta.FindStatusCondition(mirror.Status.Conditions, condType); cond != nil && cond.Status == metav1.ConditionTrue {
+			return condType, cond.LastTransitionTime.Time
+		}
+	}
+
+	if cond := meta.FindStatusCondition(mirror.Status.Conditions, JobCreated); cond != nil && cond.Status == metav1.ConditionFalse {
+		return cond.Reason, cond.LastTransitionTime.Time
+	}
+
+	return "", time.Time{}
+}
+
+func mirrorScheduledTime(mirror *imagev1.Mirror) time.Time {
+	t, err := time.Parse(time.RFC3339, mirror.GetAnnotations()[ScheduledTimeAnnotation])
+	if err != nil {
+		return mirror.CreationTimestamp.Time
+	}
+
+	return t
+}
+
+func maxScheduledTime(mirrors []*imagev1.Mirror, t time.Time) (time.Time, bool) {
+	for _, mirror := range mirrors {
+		if scheduledAt := mirrorScheduledTime(mirror); scheduledAt.After(t) {
+			t = scheduledAt
+		}
+	}
+
+	return t, !t.IsZero()
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *MirrorScheduleReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&imagev1.MirrorSchedule{}).
+		Owns(&imagev1.Mirror{}).
+		Complete(r)
+}
@@ -0,0 +1,230 @@
+package controller
+
+import (
+	"context"
+	"github.com/robfig/cron/v3"
+	imagev1 "github.com/yxwuxuanl/k8s-image-operator/api/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestNextSchedule(t *testing.T) {
+	sched, err := cron.ParseStandard("0 * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	at := func(hour, minute int) time.Time {
+		return time.Date(2024, 1, 1, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name             string
+		created          time.Time
+		lastScheduleTime time.Time
+		deadline         *int64
+		now              time.Time
+		wantMissed       time.Time
+	}{
+		{name: "never run", created: at(9, 30), now: at(12, 30), wantMissed: at(12, 0)},
+		{name: "created after the last run", created: at(12, 10), now: at(12, 30)},
+		{name: "latest of the missed runs", created: at(9, 30), lastScheduleTime: at(10, 0), now: at(12, 30), wantMissed: at(12, 0)},
+		{name: "already run", created: at(9, 30), lastScheduleTime: at(12, 0), now: at(12, 30)},
+		{name: "run at now", created: at(9, 30), lastScheduleTime: at(11, 0), now: at(12, 0), wantMissed: at(12, 0)},
+		{name: "missed the deadline", created: at(9, 30), deadline: ptr.To(int64(600)), now: at(12, 30)},
+		{name: "within the deadline", created: at(9, 30), deadline: ptr.To(int64(3600)), now: at(12, 30), wantMissed: at(12, 0)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule := &imagev1.MirrorSchedule{
+				ObjectMeta: metav1.ObjectMeta{CreationTimestamp: metav1.NewTime(tt.created)},
+				Spec:       imagev1.MirrorScheduleSpec{StartingDeadlineSeconds: tt.deadline},
+			}
+
+			missed, next := nextSchedule(schedule, sched, tt.lastScheduleTime, tt.now)
+			if !missed.Equal(tt.wantMissed) {
+				t.Errorf("missed run = %s, want %s", missed, tt.wantMissed)
+			}
+
+			if want := at(tt.now.Hour()+1, 0); !next.Equal(want) {
+				t.Errorf("next run = %s, want %s", next, want)
+			}
+		})
+	}
+}
+
+// newScheduleClient returns a fake client with schedule and its Mirrors, indexed by owner as the manager does.
+func newScheduleClient(schedule *imagev1.MirrorSchedule, mirrors ...*imagev1.Mirror) client.Client {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = imagev1.AddToScheme(scheme)
+
+	objects := []client.Object{schedule}
+	for _, mirror := range mirrors {
+		objects = append(objects, mirror)
+	}
+
+	return fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(objects...).
+		WithStatusSubresource(&imagev1.MirrorSchedule{}).
+		WithIndex(&imagev1.Mirror{}, mirrorOwnerKey, func(object client.Object) []string {
+			if owner := mirrorOwner(object.(*imagev1.Mirror)); owner != "" {
+				return []string{owner}
+			}
+
+			return nil
+		}).
+		Build()
+}
+
+// scheduledMirror returns a Mirror of schedule run at scheduledAt, finished with condType unless it is "".
+func scheduledMirror(schedule *imagev1.MirrorSchedule, name string, scheduledAt time.Time, condType string) *imagev1.Mirror {
+	mirror := &imagev1.Mirror{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   schedule.Namespace,
+			Annotations: map[string]string{ScheduledTimeAnnotation: scheduledAt.Format(time.RFC3339)},
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(schedule, imagev1.GroupVersion.WithKind("MirrorSchedule")),
+			},
+		},
+	}
+
+	if condType != "" {
+		mirror.Status.Conditions = []metav1.Condition{{Type: condType, Status: metav1.ConditionTrue, Reason: condType}}
+	}
+
+	return mirror
+}
+
+// scheduleMirrors returns the names of the Mirrors left in the namespace of schedule.
+func scheduleMirrors(t *testing.T, cli client.Client, schedule *imagev1.MirrorSchedule) []string {
+	t.Helper()
+
+	var mirrors imagev1.MirrorList
+	if err := cli.List(context.Background(), &mirrors, client.InNamespace(schedule.Namespace)); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, mirror := range mirrors.Items {
+		names = append(names, mirror.Name)
+	}
+
+	slices.Sort(names)
+	return names
+}
+
+func TestMirrorScheduleConcurrencyPolicy(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		policy      imagev1.ConcurrencyPolicy
+		wantRunning bool
+		wantCreated bool
+	}{
+		{policy: imagev1.AllowConcurrent, wantRunning: true, wantCreated: true},
+		{policy: imagev1.ForbidConcurrent, wantRunning: true},
+		{policy: imagev1.ReplaceConcurrent, wantCreated: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			schedule := &imagev1.MirrorSchedule{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:              "nightly",
+					Namespace:         "default",
+					UID:               "uid",
+					CreationTimestamp: metav1.NewTime(now.Add(-time.Hour)),
+				},
+				Spec: imagev1.MirrorScheduleSpec{
+					Schedule:          "* * * * *",
+					ConcurrencyPolicy: tt.policy,
+					Template: imagev1.MirrorSpec{
+						Images: []imagev1.MirrorImage{{Source: "nginx:1.25", Target: "myregistry/nginx:1.25"}},
+					},
+				},
+				Status: imagev1.MirrorScheduleStatus{
+					LastScheduleTime: &metav1.Time{Time: now.Add(-5 * time.Minute)},
+				},
+			}
+
+			running := scheduledMirror(schedule, "running", now.Add(-5*time.Minute), "")
+			cli := newScheduleClient(schedule, running)
+
+			recorder := record.NewFakeRecorder(10)
+			r := &MirrorScheduleReconciler{Client: cli, Scheme: cli.Scheme(), Recorder: recorder}
+
+			result, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(schedule)})
+			if err != nil {
+				t.Fatalf("Reconcile: %s", err)
+			}
+
+			if result.RequeueAfter <= 0 || result.RequeueAfter > time.Minute {
+				t.Errorf("requeue after %s, want the next minute", result.RequeueAfter)
+			}
+
+			names := scheduleMirrors(t, cli, schedule)
+			if gotRunning := slices.Contains(names, "running"); gotRunning != tt.wantRunning {
+				t.Errorf("mirrors = %v, running Mirror kept %v, want %v", names, gotRunning, tt.wantRunning)
+			}
+
+			if gotCreated := slices.ContainsFunc(names, func(name string) bool { return name != "running" }); gotCreated != tt.wantCreated {
+				t.Errorf("mirrors = %v, run created %v, want %v", names, gotCreated, tt.wantCreated)
+			}
+
+			got := &imagev1.MirrorSchedule{}
+			if err := cli.Get(context.Background(), client.ObjectKeyFromObject(schedule), got); err != nil {
+				t.Fatal(err)
+			}
+
+			if want := len(names); len(got.Status.Active) != want {
+				t.Errorf("active = %v, want the %d Mirrors left", got.Status.Active, want)
+			}
+		})
+	}
+}
+
+func TestMirrorScheduleHistory(t *testing.T) {
+	now := time.Now()
+
+	schedule := &imagev1.MirrorSchedule{
+		ObjectMeta: metav1.ObjectMeta{Name: "nightly", Namespace: "default", UID: "uid"},
+		Spec: imagev1.MirrorScheduleSpec{
+			Schedule:               "0 0 * * *",
+			Suspend:                true,
+			SuccessfulHistoryLimit: ptr.To(int32(2)),
+			FailedHistoryLimit:     ptr.To(int32(0)),
+		},
+	}
+
+	cli := newScheduleClient(schedule,
+		scheduledMirror(schedule, "succeeded-1", now.Add(-72*time.Hour), "JobComplete"),
+		scheduledMirror(schedule, "succeeded-2", now.Add(-48*time.Hour), "JobComplete"),
+		scheduledMirror(schedule, "succeeded-3", now.Add(-24*time.Hour), "JobComplete"),
+		scheduledMirror(schedule, "failed", now.Add(-36*time.Hour), "JobFailed"),
+		scheduledMirror(schedule, "running", now.Add(-time.Hour), ""),
+	)
+
+	r := &MirrorScheduleReconciler{Client: cli, Scheme: cli.Scheme(), Recorder: record.NewFakeRecorder(10)}
+
+	if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(schedule)}); err != nil {
+		t.Fatalf("Reconcile: %s", err)
+	}
+
+	// the oldest finished Mirrors beyond the limits are deleted, running ones are kept
+	if names := scheduleMirrors(t, cli, schedule); !slices.Equal(names, []string{"running", "succeeded-2", "succeeded-3"}) {
+		t.Errorf("mirrors = %v, want running, succeeded-2 and succeeded-3", names)
+	}
+}
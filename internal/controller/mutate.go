@@ -2,14 +2,19 @@ package controller
 
 import (
 	"context"
+	"encoding/json"
+	stderrors "errors"
 	"flag"
 	"fmt"
 	imagev1 "github.com/yxwuxuanl/k8s-image-operator/api/v1"
+	"github.com/yxwuxuanl/k8s-image-operator/internal/reference"
 	"gomodules.xyz/jsonpatch/v2"
+	admissionv1 "k8s.io/api/admission/v1"
 	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/utils/ptr"
 	"net/http"
 	"os"
@@ -22,6 +27,8 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 	"slices"
 	"strings"
+	"sync"
+	"time"
 )
 
 const WebhookPathPrefix = "/mutate-pod/"
@@ -29,8 +36,10 @@ const WebhookPathPrefix = "/mutate-pod/"
 var webhookClientConfig admissionregistrationv1.WebhookClientConfig
 
 var (
-	webhookServiceName = flag.String("webhook-service-name", "", "Webhook service name")
-	webhookServicePort = flag.Int("webhook-service-port", webhook.DefaultPort, "Webhook service port")
+	webhookServiceName         = flag.String("webhook-service-name", "", "Webhook service name")
+	webhookServicePort         = flag.Int("webhook-service-port", webhook.DefaultPort, "Webhook service port")
+	webhookTimeoutSeconds      = flag.Int("webhook-timeout-seconds", 10, "timeoutSeconds of the mutating webhooks, the digests of a pod are resolved within it")
+	webhookUpdateFailurePolicy = flag.String("webhook-update-failure-policy", string(admissionregistrationv1.Ignore), "failurePolicy of the webhooks of pod updates, Ignore or Fail, the failurePolicy of a Rule only applies to pod creation and ephemeral containers")
 )
 
 func buildWebhookClientConfig() (admissionregistrationv1.WebhookClientConfig, error) {
@@ -38,6 +47,16 @@ func buildWebhookClientConfig() (admissionregistrationv1.WebhookClientConfig, er
 		return admissionregistrationv1.WebhookClientConfig{}, fmt.Errorf("webhook-service-name is required")
 	}
 
+	if *webhookTimeoutSeconds < 1 || *webhookTimeoutSeconds > 30 {
+		return admissionregistrationv1.WebhookClientConfig{}, fmt.Errorf("webhook-timeout-seconds must be between 1 and 30")
+	}
+
+	switch admissionregistrationv1.FailurePolicyType(*webhookUpdateFailurePolicy) {
+	case admissionregistrationv1.Ignore, admissionregistrationv1.Fail:
+	default:
+		return admissionregistrationv1.WebhookClientConfig{}, fmt.Errorf("webhook-update-failure-policy must be Ignore or Fail")
+	}
+
 	namespace, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
 	if err != nil {
 		return admissionregistrationv1.WebhookClientConfig{}, fmt.Errorf("failed to read namespace: %w", err)
@@ -60,101 +79,498 @@ func buildWebhookClientConfig() (admissionregistrationv1.WebhookClientConfig, er
 	return webhookClientConfig, nil
 }
 
-func buildMutateHandler(decoder *admission.Decoder, rule imagev1.Rule) admission.HandlerFunc {
-	return func(ctx context.Context, request admission.Request) (response admission.Response) {
-		pod := &corev1.Pod{}
-		if err := decoder.Decode(request, pod); err != nil {
+// podMutator applies a rule to the pods sent to /mutate-pod/<rule>.
+type podMutator struct {
+	decoder  *admission.Decoder
+	rule     *ruleSet
+	resolver *digestResolver
+	stats    *ruleStats
+	recorder record.EventRecorder
+}
+
+// Reasons for denying a pod, used in metrics.
+const (
+	DenyReasonDisallowedTag  = "DisallowedTag"
+	DenyReasonInvalidImage   = "InvalidImage"
+	DenyReasonPinDigest      = "PinDigestFailed"
+	DenyReasonRegistryPolicy = "RegistryPolicy"
+)
+
+// denyError is returned by mutateContainers when the pod must be denied.
+type denyError struct {
+	reason string
+	err    error
+}
+
+func (e *denyError) Error() string {
+	return e.err.Error()
+}
+
+func (e *denyError) Unwrap() error {
+	return e.err
+}
+
+func denyf(reason string, format string, args ...any) error {
+	return &denyError{reason: reason, err: fmt.Errorf(format, args...)}
+}
+
+// containerMutation is the new image of a container.
+type containerMutation struct {
+	containerPath string
+	index         int
+	name          string
+
+	// source is the normalized image before the mutation.
+	source reference.Reference
+	image  string
+	// changed is false when the image is left as is.
+	changed bool
+}
+
+func (m containerMutation) patch() jsonpatch.JsonPatchOperation {
+	return jsonpatch.NewOperation(
+		"replace",
+		fmt.Sprintf("/spec/%s/%d/image", m.containerPath, m.index),
+		m.image,
+	)
+}
+
+func (m *podMutator) Handle(ctx context.Context, request admission.Request) admission.Response {
+	start := time.Now()
+	defer func() {
+		admissionDuration.WithLabelValues(m.rule.rule.Name).Observe(time.Since(start).Seconds())
+	}()
+
+	admissionsTotal.WithLabelValues(m.rule.rule.Name).Inc()
+
+	pod := &corev1.Pod{}
+	if err := m.decoder.Decode(request, pod); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	// on UPDATE, only the containers whose image has changed are mutated,
+	// so that the rule is not applied twice to the same image.
+	oldPod := &corev1.Pod{}
+	if request.Operation == admissionv1.Update {
+		if err := m.decoder.DecodeRaw(request.OldObject, oldPod); err != nil {
 			return admission.Errored(http.StatusBadRequest, err)
 		}
+	}
 
-		var patches []jsonpatch.JsonPatchOperation
+	// the response must reach the API server before the webhook times out
+	ctx, cancel := context.WithTimeout(ctx, admissionTimeout())
+	defer cancel()
 
-		if v, err := mutateContainers(rule, pod.Spec.InitContainers, true); err == nil {
-			patches = append(patches, v...)
-		} else {
-			return admission.Denied(err.Error())
+	mutations, err := mutatePod(ctx, m.rule, m.resolver, pod, oldPod)
+
+	if !ptr.Deref(request.DryRun, false) {
+		m.record(err, mutations)
+	}
+
+	switch m.rule.rule.Spec.EnforcementAction {
+	case imagev1.EnforcementActionWarn:
+		return admission.Allowed("").WithWarnings(m.describe(err, mutations)...)
+	case imagev1.EnforcementActionDryRun:
+		m.recordDryRun(ctx, request, err, mutations)
+		return admission.Allowed("")
+	}
+
+	if !ptr.Deref(request.DryRun, false) {
+		m.recordEvents(request, pod, err, mutations)
+	}
+
+	if err != nil {
+		return admission.Denied(err.Error())
+	}
+
+	patches := make([]jsonpatch.JsonPatchOperation, 0, len(mutations))
+	for _, mutation := range mutations {
+		patches = append(patches, mutation.patch())
+	}
+
+	return admission.Patched("", patches...)
+}
+
+// record updates the counters in the rule status and the metrics.
+// In warn and dryRun modes the pod is admitted unchanged, so it is only counted as warned.
+func (m *podMutator) record(err error, mutations []containerMutation) {
+	if action := m.rule.rule.Spec.EnforcementAction; action == imagev1.EnforcementActionWarn || action == imagev1.EnforcementActionDryRun {
+		if err != nil || len(mutations) > 0 {
+			m.stats.podsWarned.Add(1)
+			podsWarnedTotal.WithLabelValues(m.rule.rule.Name, string(action)).Inc()
 		}
+		return
+	}
 
-		if v, err := mutateContainers(rule, pod.Spec.Containers, false); err == nil {
-			patches = append(patches, v...)
-		} else {
-			return admission.Denied(err.Error())
+	if err != nil {
+		m.stats.podsDenied.Add(1)
+
+		reason := DenyReasonInvalidImage
+		if denial := (*denyError)(nil); stderrors.As(err, &denial) {
+			reason = denial.reason
 		}
 
-		return admission.Patched("", patches...)
+		denialsTotal.WithLabelValues(m.rule.rule.Name, reason).Inc()
+		return
+	}
+
+	if len(mutations) == 0 {
+		return
 	}
+
+	m.stats.podsMutated.Add(1)
+	m.stats.containersRewritten.Add(int64(len(mutations)))
+
+	for _, mutation := range mutations {
+		containersRewrittenTotal.WithLabelValues(m.rule.rule.Name, mutation.source.Domain).Inc()
+	}
+}
+
+// describe returns what the rule would have done to the pod in enforce mode.
+func (m *podMutator) describe(err error, mutations []containerMutation) []string {
+	if err != nil {
+		return []string{fmt.Sprintf("rule %s would deny the pod: %s", m.rule.rule.Name, err)}
+	}
+
+	var messages []string
+	for _, mutation := range mutations {
+		messages = append(messages, fmt.Sprintf(
+			"rule %s would set the image of %s: %s to %s",
+			m.rule.rule.Name, mutation.containerPath, mutation.name, mutation.image,
+		))
+	}
+
+	return messages
+}
+
+func (m *podMutator) recordDryRun(ctx context.Context, request admission.Request, err error, mutations []containerMutation) {
+	if err == nil && len(mutations) == 0 {
+		return
+	}
+
+	logger := log.FromContext(ctx).WithValues(
+		"rule", m.rule.rule.Name,
+		"namespace", request.Namespace,
+		"pod", podName(request),
+	)
+
+	reason, eventType := "DryRunRewrite", corev1.EventTypeNormal
+	if err != nil {
+		reason, eventType = "DryRunDeny", corev1.EventTypeWarning
+	}
+
+	for _, message := range m.describe(err, mutations) {
+		logger.Info(message, "enforcementAction", imagev1.EnforcementActionDryRun)
+
+		if !ptr.Deref(request.DryRun, false) {
+			m.recorder.Eventf(&m.rule.rule, eventType, reason, "%s in pod %s/%s", message, request.Namespace, podName(request))
+		}
+	}
+}
+
+// recordEvents records the rewrites and the denial on the rule and on the workload owning the pod.
+func (m *podMutator) recordEvents(request admission.Request, pod *corev1.Pod, err error, mutations []containerMutation) {
+	owner := eventOwner(request, pod)
+	name := request.Namespace + "/" + podName(request)
+
+	if err != nil {
+		m.recorder.Eventf(&m.rule.rule, corev1.EventTypeWarning, "Denied", "Denied pod %s: %s", name, err)
+		if owner != nil {
+			m.recorder.Eventf(owner, corev1.EventTypeWarning, "ImageDenied", "Rule %s denied pod %s: %s", m.rule.rule.Name, name, err)
+		}
+		return
+	}
+
+	for _, mutation := range mutations {
+		m.recorder.Eventf(
+			&m.rule.rule, corev1.EventTypeNormal, "Rewritten",
+			"Rewrote image of %s: %s in pod %s from %s to %s",
+			mutation.containerPath, mutation.name, name, mutation.source, mutation.image,
+		)
+
+		if owner != nil {
+			m.recorder.Eventf(
+				owner, corev1.EventTypeNormal, "ImageRewritten",
+				"Rule %s rewrote image of %s: %s in pod %s from %s to %s",
+				m.rule.rule.Name, mutation.containerPath, mutation.name, name, mutation.source, mutation.image,
+			)
+		}
+	}
+}
+
+// eventOwner returns the object the events of a pod are recorded on: its
+// controller, e.g. a ReplicaSet or a Job, or the pod itself if it already exists.
+func eventOwner(request admission.Request, pod *corev1.Pod) *corev1.ObjectReference {
+	if owner := v1.GetControllerOf(pod); owner != nil {
+		return &corev1.ObjectReference{
+			APIVersion: owner.APIVersion,
+			Kind:       owner.Kind,
+			Name:       owner.Name,
+			Namespace:  request.Namespace,
+			UID:        owner.UID,
+		}
+	}
+
+	if request.Operation == admissionv1.Update {
+		return &corev1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "Pod",
+			Name:       pod.Name,
+			Namespace:  request.Namespace,
+			UID:        pod.UID,
+		}
+	}
+
+	return nil
+}
+
+// podName returns the name of the pod in the request, pods created from a
+// template only have a generateName at admission time.
+func podName(request admission.Request) string {
+	if request.Name != "" {
+		return request.Name
+	}
+
+	var pod v1.PartialObjectMetadata
+	if err := json.Unmarshal(request.Object.Raw, &pod); err == nil && pod.GenerateName != "" {
+		return pod.GenerateName + "*"
+	}
+
+	return "<unknown>"
 }
 
-func mutateContainers(rule imagev1.Rule, containers []corev1.Container, isInitContainers bool) (patches []jsonpatch.JsonPatchOperation, err error) {
-	var containerPath string
-	if isInitContainers {
-		containerPath = "initContainers"
+// admissionTimeout returns how long the handling of an admission request may take, leaving
+// part of the timeout of the webhook to send the response.
+func admissionTimeout() time.Duration {
+	timeout := time.Duration(*webhookTimeoutSeconds) * time.Second
+	return timeout - min(time.Second, timeout/2)
+}
+
+func mutatePod(ctx context.Context, rule *ruleSet, resolver *digestResolver, pod, oldPod *corev1.Pod) (mutations []containerMutation, err error) {
+	if v, err := mutateContainers(rule, pod.Spec.InitContainers, oldPod.Spec.InitContainers, "initContainers"); err == nil {
+		mutations = append(mutations, v...)
+	} else {
+		return nil, err
+	}
+
+	if v, err := mutateContainers(rule, pod.Spec.Containers, oldPod.Spec.Containers, "containers"); err == nil {
+		mutations = append(mutations, v...)
 	} else {
-		containerPath = "containers"
+		return nil, err
+	}
+
+	if v, err := mutateContainers(
+		rule,
+		ephemeralToContainers(pod.Spec.EphemeralContainers),
+		ephemeralToContainers(oldPod.Spec.EphemeralContainers),
+		"ephemeralContainers",
+	); err == nil {
+		mutations = append(mutations, v...)
+	} else {
+		return nil, err
+	}
+
+	if rule.rule.Spec.PinDigest {
+		if err := pinDigests(ctx, rule, resolver, mutations); err != nil {
+			return nil, err
+		}
+	}
+
+	// only the containers whose image has changed are patched
+	return slices.DeleteFunc(mutations, func(mutation containerMutation) bool {
+		return !mutation.changed
+	}), nil
+}
+
+func ephemeralToContainers(ephemeralContainers []corev1.EphemeralContainer) []corev1.Container {
+	containers := make([]corev1.Container, 0, len(ephemeralContainers))
+	for _, ephemeralContainer := range ephemeralContainers {
+		containers = append(containers, corev1.Container(ephemeralContainer.EphemeralContainerCommon))
+	}
+
+	return containers
+}
+
+// mutateContainers returns the mutations of the containers at /spec/<containerPath>,
+// skipping the containers whose image is the same as in oldContainers. The images
+// that are not rewritten are returned too, unchanged, for their digest to be pinned.
+func mutateContainers(
+	rule *ruleSet,
+	containers, oldContainers []corev1.Container,
+	containerPath string,
+) (mutations []containerMutation, err error) {
+	oldImages := make(map[string]string, len(oldContainers))
+	for _, container := range oldContainers {
+		oldImages[container.Name] = container.Image
 	}
 
 	for i, container := range containers {
-		hasDisallowedTag := slices.ContainsFunc(rule.Spec.DisallowedTags, func(s string) bool {
-			return s == getImageTag(container.Image)
-		})
+		if image, ok := oldImages[container.Name]; ok && image == container.Image {
+			continue
+		}
 
-		if hasDisallowedTag {
-			return nil, fmt.Errorf(
-				"[%s] tags is not allowed in %s: %s",
-				strings.Join(rule.Spec.DisallowedTags, " "), containerPath, container.Name,
+		ref, err := normalizeImage(container.Image)
+		if err != nil {
+			// the registry and tag of the image are unknown, so neither the policy nor the disallowed tags can allow it
+			if rule.rule.Spec.Policy != nil || len(rule.rule.Spec.DisallowedTags) > 0 {
+				return nil, denyf(DenyReasonInvalidImage, "invalid image %s in %s: %s: %w", container.Image, containerPath, container.Name, err)
+			}
+
+			ctrl.Log.Error(
+				err, "unable to parse image",
+				"container", containerPath+"/"+container.Name,
+				"image", container.Image,
+				"rule", rule.rule.Name,
 			)
+			continue
 		}
 
-		if image, isRewrite := rewriteImage(container.Image, rule.Spec.Rewrite); isRewrite {
-			patches = append(patches, jsonpatch.NewOperation(
-				"replace",
-				fmt.Sprintf("/spec/%s/%d/image", containerPath, i),
-				image,
-			))
+		if rule.isDisallowedTag(ref.Tag) {
+			return nil, denyf(
+				DenyReasonDisallowedTag,
+				"[%s] tags is not allowed in %s: %s",
+				strings.Join(rule.rule.Spec.DisallowedTags, " "), containerPath, container.Name,
+			)
+		}
 
+		image, isRewrite := rule.rewrite(ref)
+		if isRewrite {
 			ctrl.Log.Info(
 				"image has been rewritten",
 				"container", containerPath+"/"+container.Name,
 				"image", image,
 				"raw_image", container.Image,
-				"rule", rule.Name,
+				"rule", rule.rule.Name,
 			)
+		} else {
+			image = container.Image
+		}
+
+		if rule.rule.Spec.Policy != nil {
+			final := ref
+			if isRewrite {
+				if final, err = normalizeImage(image); err != nil {
+					return nil, denyf(DenyReasonInvalidImage, "invalid image %s in %s: %s: %w", image, containerPath, container.Name, err)
+				}
+			}
+
+			if err := rule.checkRegistry(final); err != nil {
+				return nil, denyf(DenyReasonRegistryPolicy, "%s in %s: %s", err, containerPath, container.Name)
+			}
 		}
+
+		mutations = append(mutations, containerMutation{
+			containerPath: containerPath,
+			index:         i,
+			name:          container.Name,
+			source:        ref,
+			image:         image,
+			changed:       isRewrite,
+		})
 	}
 
-	return patches, nil
+	return mutations, nil
 }
 
-func updateMutatingWebhookConfiguration(ctx context.Context, cli client.Client, rules []imagev1.Rule) error {
-	mutatingWebhookConfiguration := &admissionregistrationv1.MutatingWebhookConfiguration{
-		ObjectMeta: v1.ObjectMeta{
-			Name: "webhook." + imagev1.GroupVersion.Group,
-		},
+// pinDigests pins the images of mutations to their digest. The images are resolved
+// concurrently, so that a pod with many containers is resolved within the deadline of ctx.
+func pinDigests(ctx context.Context, rule *ruleSet, resolver *digestResolver, mutations []containerMutation) error {
+	type pinResult struct {
+		pinned string
+		err    error
 	}
 
-	if len(rules) == 0 {
-		if err := cli.Delete(ctx, mutatingWebhookConfiguration); err != nil {
-			if !errors.IsNotFound(err) {
-				log.FromContext(ctx).Error(err, "failed to delete mutating webhook configuration")
-				return err
+	results := make(map[string]*pinResult, len(mutations))
+	for _, mutation := range mutations {
+		results[mutation.image] = &pinResult{}
+	}
+
+	var wg sync.WaitGroup
+	for image, result := range results {
+		wg.Add(1)
+		go func(image string, result *pinResult) {
+			defer wg.Done()
+			result.pinned, result.err = pinDigest(ctx, resolver, rule.rule, image)
+		}(image, result)
+	}
+	wg.Wait()
+
+	for i := range mutations {
+		mutation := &mutations[i]
+		result := results[mutation.image]
+
+		if result.err != nil {
+			if rule.rule.Spec.FailurePolicy == string(admissionregistrationv1.Fail) {
+				return denyf(DenyReasonPinDigest, "unable to pin digest in %s: %s: %w", mutation.containerPath, mutation.name, result.err)
 			}
+
+			ctrl.Log.Error(
+				result.err, "unable to pin digest",
+				"container", mutation.containerPath+"/"+mutation.name,
+				"image", mutation.image,
+				"rule", rule.rule.Name,
+			)
+			continue
 		}
-		return nil
+
+		// an image that is already pinned is left as written
+		if result.pinned == mutation.image {
+			continue
+		}
+
+		ctrl.Log.Info(
+			"image digest has been pinned",
+			"container", mutation.containerPath+"/"+mutation.name,
+			"image", result.pinned,
+			"raw_image", mutation.image,
+			"rule", rule.rule.Name,
+		)
+
+		mutation.image = result.pinned
+		mutation.changed = true
+	}
+
+	return nil
+}
+
+// pinDigest returns image as repository@digest, resolving the tag against the registry.
+// An image with a digest is returned as is.
+func pinDigest(ctx context.Context, resolver *digestResolver, rule imagev1.Rule, image string) (string, error) {
+	ref, err := normalizeImage(image)
+	if err != nil {
+		return "", fmt.Errorf("invalid image %s: %w", image, err)
+	}
+
+	if ref.Digest != "" {
+		return image, nil
+	}
+
+	digest, err := resolver.resolve(ctx, ref, rule.Spec.DockerConfig)
+	if err != nil {
+		return "", err
 	}
 
-	var webhooks []admissionregistrationv1.MutatingWebhook
+	return ref.WithTag("").WithDigest(digest).String(), nil
+}
+
+// updateMutatingWebhookConfiguration registers the webhooks of rules in two configurations: pod creation and the
+// ephemeral containers with the failurePolicy of the rule, and the other pod updates with --webhook-update-failure-policy.
+// Webhook names only have to be unique within a configuration, so that no rule name can collide with another webhook.
+func updateMutatingWebhookConfiguration(ctx context.Context, cli client.Client, rules []imagev1.Rule) error {
+	var createWebhooks, updateWebhooks []admissionregistrationv1.MutatingWebhook
 
 	for _, rule := range rules {
 		clientConfig := webhookClientConfig.DeepCopy()
 		clientConfig.Service.Path = ptr.To(WebhookPathPrefix + rule.Name)
 
-		webhooks = append(webhooks, admissionregistrationv1.MutatingWebhook{
+		create := admissionregistrationv1.MutatingWebhook{
 			Name:              rule.Name + "." + imagev1.GroupVersion.Group,
 			ClientConfig:      *clientConfig,
 			ObjectSelector:    rule.Spec.PodSelector,
 			NamespaceSelector: rule.Spec.NamespaceSelector,
 			FailurePolicy:     ptr.To(admissionregistrationv1.FailurePolicyType(rule.Spec.FailurePolicy)),
 			SideEffects:       ptr.To(admissionregistrationv1.SideEffectClassNone),
+			TimeoutSeconds:    ptr.To(int32(*webhookTimeoutSeconds)),
 			AdmissionReviewVersions: []string{
 				admissionregistrationv1.SchemeGroupVersion.Version,
 			},
@@ -167,8 +583,61 @@ func updateMutatingWebhookConfiguration(ctx context.Context, cli client.Client,
 						Resources:   []string{"pods"},
 					},
 				},
+				{
+					// ephemeral containers, e.g. from `kubectl debug`, are added through the subresource,
+					// they must not bypass the rule when the webhook is down
+					Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Update},
+					Rule: admissionregistrationv1.Rule{
+						APIGroups:   []string{""},
+						APIVersions: []string{"v1"},
+						Resources:   []string{"pods/ephemeralcontainers"},
+					},
+				},
 			},
-		})
+		}
+
+		// every update of every selected pod goes through this webhook, such as the label updates of
+		// controllers, so by default it is ignored when the webhook is down instead of blocking them
+		update := *create.DeepCopy()
+		update.FailurePolicy = ptr.To(admissionregistrationv1.FailurePolicyType(*webhookUpdateFailurePolicy))
+		update.Rules = []admissionregistrationv1.RuleWithOperations{
+			{
+				Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Update},
+				Rule: admissionregistrationv1.Rule{
+					APIGroups:   []string{""},
+					APIVersions: []string{"v1"},
+					Resources:   []string{"pods"},
+				},
+			},
+		}
+
+		createWebhooks = append(createWebhooks, create)
+		updateWebhooks = append(updateWebhooks, update)
+	}
+
+	if err := applyMutatingWebhookConfiguration(ctx, cli, "webhook."+imagev1.GroupVersion.Group, createWebhooks); err != nil {
+		return err
+	}
+
+	return applyMutatingWebhookConfiguration(ctx, cli, "webhook-update."+imagev1.GroupVersion.Group, updateWebhooks)
+}
+
+// applyMutatingWebhookConfiguration sets the webhooks of the configuration name, deleting it when there are none.
+func applyMutatingWebhookConfiguration(ctx context.Context, cli client.Client, name string, webhooks []admissionregistrationv1.MutatingWebhook) error {
+	mutatingWebhookConfiguration := &admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: v1.ObjectMeta{
+			Name: name,
+		},
+	}
+
+	if len(webhooks) == 0 {
+		if err := cli.Delete(ctx, mutatingWebhookConfiguration); err != nil {
+			if !errors.IsNotFound(err) {
+				log.FromContext(ctx).Error(err, "failed to delete mutating webhook configuration", "name", name)
+				return err
+			}
+		}
+		return nil
 	}
 
 	op, err := controllerutil.CreateOrUpdate(ctx, cli, mutatingWebhookConfiguration, func() error {
@@ -177,10 +646,10 @@ func updateMutatingWebhookConfiguration(ctx context.Context, cli client.Client,
 	})
 
 	if err != nil {
-		log.FromContext(ctx).Error(err, "failed to create or update mutating webhook configuration")
+		log.FromContext(ctx).Error(err, "failed to create or update mutating webhook configuration", "name", name)
 		return err
 	}
 
-	log.FromContext(ctx).Info(string("mutating webhook configuration has been " + op))
+	log.FromContext(ctx).Info(string("mutating webhook configuration has been "+op), "name", name)
 	return nil
 }
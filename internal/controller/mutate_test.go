@@ -0,0 +1,288 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	imagev1 "github.com/yxwuxuanl/k8s-image-operator/api/v1"
+	"github.com/yxwuxuanl/k8s-image-operator/internal/reference"
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	"slices"
+	"testing"
+)
+
+func TestPodMutatorRecord(t *testing.T) {
+	mutations := []containerMutation{{name: "app", source: reference.Reference{Domain: "docker.io"}, image: "mirror.local/nginx:1.25"}}
+
+	tests := []struct {
+		action      imagev1.EnforcementAction
+		err         error
+		mutations   []containerMutation
+		wantMutated int64
+		wantDenied  int64
+		wantWarned  int64
+	}{
+		{action: imagev1.EnforcementActionEnforce, mutations: mutations, wantMutated: 1},
+		{action: imagev1.EnforcementActionEnforce, err: errors.New("denied"), wantDenied: 1},
+		{action: imagev1.EnforcementActionEnforce},
+		{action: imagev1.EnforcementActionWarn, mutations: mutations, wantWarned: 1},
+		{action: imagev1.EnforcementActionWarn, err: errors.New("denied"), wantWarned: 1},
+		{action: imagev1.EnforcementActionDryRun, err: errors.New("denied"), wantWarned: 1},
+		{action: imagev1.EnforcementActionDryRun},
+	}
+
+	for _, tt := range tests {
+		rule := newRule()
+		rule.Spec.EnforcementAction = tt.action
+
+		m := &podMutator{rule: &ruleSet{rule: rule}, stats: &ruleStats{}}
+		m.record(tt.err, tt.mutations)
+
+		if got := m.stats.podsMutated.Load(); got != tt.wantMutated {
+			t.Errorf("%s, %v: podsMutated = %d, want %d", tt.action, tt.err, got, tt.wantMutated)
+		}
+		if got := m.stats.podsDenied.Load(); got != tt.wantDenied {
+			t.Errorf("%s, %v: podsDenied = %d, want %d", tt.action, tt.err, got, tt.wantDenied)
+		}
+		if got := m.stats.podsWarned.Load(); got != tt.wantWarned {
+			t.Errorf("%s, %v: podsWarned = %d, want %d", tt.action, tt.err, got, tt.wantWarned)
+		}
+	}
+}
+
+func TestMutatePodUpdate(t *testing.T) {
+	rs, err := compileRuleSet(newRule(imagev1.RewriteRule{Registry: "docker.io", Replacement: "mirror.local"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldPod := &corev1.Pod{}
+	oldPod.Spec.Containers = []corev1.Container{
+		{Name: "app", Image: "nginx:1.25"},
+		{Name: "cache", Image: "redis:7"},
+	}
+
+	// the kubelet or a controller updating the pod sends the images already admitted, app must not be rewritten again
+	pod := oldPod.DeepCopy()
+	pod.Spec.Containers[1].Image = "redis:7.2"
+	pod.Spec.EphemeralContainers = []corev1.EphemeralContainer{
+		{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debug", Image: "busybox"}},
+	}
+
+	mutations, err := mutatePod(context.Background(), rs, nil, pod, oldPod)
+	if err != nil {
+		t.Fatalf("mutatePod() error = %v", err)
+	}
+
+	want := []string{
+		"/spec/containers/1/image mirror.local/library/redis:7.2",
+		"/spec/ephemeralContainers/0/image mirror.local/library/busybox:latest",
+	}
+
+	var got []string
+	for _, mutation := range mutations {
+		patch := mutation.patch()
+		got = append(got, fmt.Sprintf("%s %v", patch.Path, patch.Value))
+	}
+
+	if !slices.Equal(got, want) {
+		t.Errorf("mutatePod() = %q, want %q", got, want)
+	}
+}
+
+func TestMutatePodEphemeralContainerDenied(t *testing.T) {
+	rule := newRule()
+	rule.Spec.DisallowedTags = []string{"latest"}
+
+	rs, err := compileRuleSet(rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldPod := &corev1.Pod{}
+	oldPod.Spec.Containers = []corev1.Container{{Name: "app", Image: "nginx:1.25"}}
+
+	pod := oldPod.DeepCopy()
+	pod.Spec.EphemeralContainers = []corev1.EphemeralContainer{
+		{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debug", Image: "busybox"}},
+	}
+
+	_, err = mutatePod(context.Background(), rs, nil, pod, oldPod)
+
+	var denial *denyError
+	if !errors.As(err, &denial) || denial.reason != DenyReasonDisallowedTag {
+		t.Errorf("mutatePod() error = %v, want a %s denial", err, DenyReasonDisallowedTag)
+	}
+}
+
+func TestUpdateMutatingWebhookConfiguration(t *testing.T) {
+	webhookClientConfig = admissionregistrationv1.WebhookClientConfig{
+		Service: &admissionregistrationv1.ServiceReference{Name: "image-operator", Namespace: "default"},
+	}
+
+	// the webhooks of a rule named <x>.update must not collide with those of <x>
+	rules := []imagev1.Rule{newRule(), newRule()}
+	rules[0].Name, rules[0].Spec.FailurePolicy = "mirror", string(admissionregistrationv1.Fail)
+	rules[1].Name, rules[1].Spec.FailurePolicy = "mirror.update", string(admissionregistrationv1.Fail)
+
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	cli := fake.NewClientBuilder().WithScheme(scheme).Build()
+	ctx := context.Background()
+
+	if err := updateMutatingWebhookConfiguration(ctx, cli, rules); err != nil {
+		t.Fatalf("updateMutatingWebhookConfiguration() error = %v", err)
+	}
+
+	for name, want := range map[string]struct {
+		failurePolicy admissionregistrationv1.FailurePolicyType
+		resources     []string
+	}{
+		"webhook." + imagev1.GroupVersion.Group:        {admissionregistrationv1.Fail, []string{"pods", "pods/ephemeralcontainers"}},
+		"webhook-update." + imagev1.GroupVersion.Group: {admissionregistrationv1.Ignore, []string{"pods"}},
+	} {
+		config := &admissionregistrationv1.MutatingWebhookConfiguration{}
+		if err := cli.Get(ctx, client.ObjectKey{Name: name}, config); err != nil {
+			t.Fatalf("get %s: %s", name, err)
+		}
+
+		names := map[string]bool{}
+		for _, webhook := range config.Webhooks {
+			if names[webhook.Name] {
+				t.Errorf("%s: duplicate webhook %s", name, webhook.Name)
+			}
+			names[webhook.Name] = true
+
+			var resources []string
+			for _, rule := range webhook.Rules {
+				resources = append(resources, rule.Resources...)
+			}
+
+			if *webhook.FailurePolicy != want.failurePolicy || !slices.Equal(resources, want.resources) {
+				t.Errorf("%s: webhook %s has failurePolicy %s on %v, want %s on %v",
+					name, webhook.Name, *webhook.FailurePolicy, resources, want.failurePolicy, want.resources)
+			}
+		}
+
+		if len(names) != len(rules) {
+			t.Errorf("%s has %d webhooks, want %d", name, len(names), len(rules))
+		}
+	}
+
+	// the configurations are deleted with the last rule
+	if err := updateMutatingWebhookConfiguration(ctx, cli, nil); err != nil {
+		t.Fatalf("updateMutatingWebhookConfiguration() error = %v", err)
+	}
+
+	configs := &admissionregistrationv1.MutatingWebhookConfigurationList{}
+	if err := cli.List(ctx, configs); err != nil || len(configs.Items) > 0 {
+		t.Errorf("%d configurations left, error %v", len(configs.Items), err)
+	}
+}
+
+func TestPodMutatorEvents(t *testing.T) {
+	pod := &corev1.Pod{}
+	pod.GenerateName = "web-7d9f8-"
+	pod.OwnerReferences = []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "web-7d9f8", Controller: ptr.To(true)}}
+	pod.Spec.Containers = []corev1.Container{{Name: "app", Image: "nginx:1.25"}}
+
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	denied := pod.DeepCopy()
+	denied.Spec.Containers[0].Image = "nginx:latest"
+
+	rawDenied, err := json.Marshal(denied)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		action imagev1.EnforcementAction
+		raw    []byte
+		dryRun bool
+		want   []string
+	}{
+		{
+			name: "rewrite",
+			raw:  raw,
+			want: []string{
+				"Normal Rewritten Rewrote image of containers: app in pod default/web-7d9f8-* from docker.io/library/nginx:1.25 to mirror.local/library/nginx:1.25",
+				"Normal ImageRewritten Rule test rewrote image of containers: app in pod default/web-7d9f8-* from docker.io/library/nginx:1.25 to mirror.local/library/nginx:1.25",
+			},
+		},
+		{
+			name: "denial",
+			raw:  rawDenied,
+			want: []string{
+				"Warning Denied Denied pod default/web-7d9f8-*: [latest] tags is not allowed in containers: app",
+				"Warning ImageDenied Rule test denied pod default/web-7d9f8-*: [latest] tags is not allowed in containers: app",
+			},
+		},
+		{
+			name:   "dry run request",
+			raw:    raw,
+			dryRun: true,
+		},
+		{
+			name:   "dryRun rule",
+			action: imagev1.EnforcementActionDryRun,
+			raw:    raw,
+			want: []string{
+				"Normal DryRunRewrite rule test would set the image of containers: app to mirror.local/library/nginx:1.25 in pod default/web-7d9f8-*",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := newRule(imagev1.RewriteRule{Registry: "docker.io", Replacement: "mirror.local"})
+			rule.Spec.DisallowedTags = []string{"latest"}
+			rule.Spec.EnforcementAction = tt.action
+
+			rs, err := compileRuleSet(rule)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recorder := record.NewFakeRecorder(10)
+			m := &podMutator{
+				decoder:  admission.NewDecoder(clientgoscheme.Scheme),
+				rule:     rs,
+				stats:    &ruleStats{},
+				recorder: recorder,
+			}
+
+			m.Handle(context.Background(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+				Operation: admissionv1.Create,
+				Namespace: "default",
+				Object:    runtime.RawExtension{Raw: tt.raw},
+				DryRun:    ptr.To(tt.dryRun),
+			}})
+			close(recorder.Events)
+
+			var got []string
+			for event := range recorder.Events {
+				got = append(got, event)
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("events = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package controller
+
+import (
+	"encoding/json"
+	"github.com/yxwuxuanl/k8s-image-operator/internal/agent"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// mirrorPodResult is the result reported by the containers of a mirror pod.
+type mirrorPodResult struct {
+	sourceDigest string
+	// upToDate are the digests of the skipped targets, by index of the target.
+	upToDate map[int]string
+
+	// targetDigest, size, layers and platforms describe what the targets have.
+	targetDigest string
+	size         int64
+	layers       int32
+	platforms    []string
+
+	// referrers are the numbers of copied referrers, by index of the target.
+	referrers map[int]int32
+
+	// failedTarget is the index of the target that failed, -1 when the stage failed for all of them.
+	failedTarget int
+	failedStage  string
+	output       string
+}
+
+// parseMirrorPodResult reads the result of pod from the termination messages of its containers,
+// each one is the agent.Result of its stage.
+func parseMirrorPodResult(pod *corev1.Pod) *mirrorPodResult {
+	result := &mirrorPodResult{
+		upToDate:     make(map[int]string),
+		referrers:    make(map[int]int32),
+		failedTarget: -1,
+	}
+
+	for _, status := range append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...) {
+		terminated := status.State.Terminated
+		if terminated == nil || terminated.Message == "" {
+			continue
+		}
+
+		var containerResult agent.Result
+		if err := json.Unmarshal([]byte(terminated.Message), &containerResult); err != nil {
+			continue
+		}
+
+		if containerResult.SourceDigest != "" {
+			result.sourceDigest = containerResult.SourceDigest
+		}
+
+		for target, digest := range containerResult.UpToDate {
+			result.upToDate[target] = digest
+		}
+
+		for target, copied := range containerResult.Referrers {
+			result.referrers[target] = copied
+		}
+
+		// the push describes what it pushed after the check described the up to date targets
+		if containerResult.TargetDigest != "" {
+			result.targetDigest = containerResult.TargetDigest
+			result.size = containerResult.Size
+			result.layers = containerResult.Layers
+			result.platforms = containerResult.Platforms
+		}
+
+		if failure := containerResult.Failure; failure != nil {
+			result.failedTarget = failure.Target
+			result.failedStage = failure.Stage
+			result.output = failure.Output
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,121 @@
+package controller
+
+import (
+	"encoding/json"
+	"github.com/yxwuxuanl/k8s-image-operator/internal/agent"
+	corev1 "k8s.io/api/core/v1"
+	"testing"
+)
+
+// mirrorPod returns a pod whose containers, in order, terminated with results.
+func mirrorPod(t *testing.T, phase corev1.PodPhase, results ...agent.Result) *corev1.Pod {
+	t.Helper()
+
+	pod := &corev1.Pod{}
+	pod.Status.Phase = phase
+
+	for i, result := range results {
+		message, err := json.Marshal(result)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		status := corev1.ContainerStatus{
+			State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Message: string(message)}},
+		}
+
+		// the check and pull stages are init containers of the push
+		if i < len(results)-1 {
+			pod.Status.InitContainerStatuses = append(pod.Status.InitContainerStatuses, status)
+		} else {
+			pod.Status.ContainerStatuses = append(pod.Status.ContainerStatuses, status)
+		}
+	}
+
+	return pod
+}
+
+func TestParseMirrorPodResult(t *testing.T) {
+	pod := mirrorPod(t, corev1.PodFailed,
+		agent.Result{
+			SourceDigest: "sha256:source",
+			UpToDate:     map[int]string{0: "sha256:source"},
+			TargetDigest: "sha256:source",
+			Size:         100,
+			Layers:       1,
+		},
+		agent.Result{},
+		agent.Result{
+			TargetDigest: "sha256:pushed",
+			Size:         200,
+			Layers:       2,
+			Platforms:    []string{"linux/amd64"},
+			Referrers:    map[int]int32{0: 1, 1: 2},
+			Failure:      &agent.Failure{Target: 2, Stage: agent.StagePush, Output: "denied"},
+		},
+	)
+
+	result := parseMirrorPodResult(pod)
+
+	if result.sourceDigest != "sha256:source" || result.upToDate[0] != "sha256:source" {
+		t.Errorf("check result = %s, %v, want the digest of the source up to date at target 0", result.sourceDigest, result.upToDate)
+	}
+
+	// the push describes what it pushed after the check described the up to date targets
+	if result.targetDigest != "sha256:pushed" || result.size != 200 || result.layers != 2 || len(result.platforms) != 1 {
+		t.Errorf("described = %s, %d bytes, %d layers, %v, want the push", result.targetDigest, result.size, result.layers, result.platforms)
+	}
+
+	if result.referrers[1] != 2 {
+		t.Errorf("referrers = %v, want 2 at target 1", result.referrers)
+	}
+
+	if result.failedTarget != 2 || result.failedStage != agent.StagePush || result.output != "denied" {
+		t.Errorf("failure = %d, %s, %s, want target 2 in %s", result.failedTarget, result.failedStage, result.output, agent.StagePush)
+	}
+
+	// messages that aren't results, e.g. of a container killed before writing one, are ignored
+	pod.Status.ContainerStatuses[0].State.Terminated.Message = "OOMKilled"
+	if result := parseMirrorPodResult(pod); result.failedStage != "" || result.failedTarget != -1 || result.sourceDigest != "sha256:source" {
+		t.Errorf("parseMirrorPodResult() = %+v, want only the check result", result)
+	}
+}
+
+func TestMirrorTargetPhase(t *testing.T) {
+	checkFailed := mirrorPod(t, corev1.PodFailed, agent.Result{Failure: &agent.Failure{Target: -1, Stage: agent.StageCheck, Output: "manifest unknown"}})
+
+	pushFailed := mirrorPod(t, corev1.PodFailed,
+		agent.Result{SourceDigest: "sha256:source", UpToDate: map[int]string{3: "sha256:source"}},
+		agent.Result{},
+		agent.Result{Failure: &agent.Failure{Target: 1, Stage: agent.StagePush}},
+	)
+
+	evicted := mirrorPod(t, corev1.PodFailed)
+	evicted.Status.Message = "The node was low on resource: ephemeral-storage."
+
+	tests := []struct {
+		name        string
+		pod         *corev1.Pod
+		target      int
+		wantPhase   string
+		wantMessage string
+	}{
+		{name: "running", pod: mirrorPod(t, corev1.PodRunning), wantPhase: string(corev1.PodRunning)},
+		{name: "succeeded", pod: mirrorPod(t, corev1.PodSucceeded, agent.Result{}), wantPhase: string(corev1.PodSucceeded)},
+		{name: "failed stage of every target", pod: checkFailed, target: 1, wantPhase: string(corev1.PodFailed), wantMessage: "check failed"},
+		{name: "target before the failed one", pod: pushFailed, target: 0, wantPhase: string(corev1.PodSucceeded)},
+		{name: "failed target", pod: pushFailed, target: 1, wantPhase: string(corev1.PodFailed), wantMessage: "push failed"},
+		{name: "target after the failed one", pod: pushFailed, target: 2, wantPhase: string(corev1.PodFailed), wantMessage: "not mirrored, target 1 failed before"},
+		{name: "up to date target", pod: pushFailed, target: 3, wantPhase: ImageSkipped, wantMessage: "target is up to date"},
+		{name: "no stage reported", pod: evicted, wantPhase: string(corev1.PodFailed), wantMessage: evicted.Status.Message},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			phase, message := mirrorTargetPhase(tt.pod, parseMirrorPodResult(tt.pod), tt.target)
+			if phase != tt.wantPhase || message != tt.wantMessage {
+				t.Errorf("mirrorTargetPhase() = %s, %q, want %s, %q", phase, message, tt.wantPhase, tt.wantMessage)
+			}
+		})
+	}
+}
@@ -18,12 +18,20 @@ package controller
 
 import (
 	"context"
+	"errors"
 	imagev1 "github.com/yxwuxuanl/k8s-image-operator/api/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	toolscache "k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
 	"net/http"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 	"slices"
@@ -36,15 +44,25 @@ var ruleNameCtxKey = struct{}{}
 // RuleReconciler reconciles a Rule object
 type RuleReconciler struct {
 	client.Client
-	Scheme  *runtime.Scheme
-	decoder *admission.Decoder
-
-	handlers sync.Map
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+	decoder  *admission.Decoder
+
+	handlers     sync.Map
+	handlersSync toolscache.ResourceEventHandlerRegistration
+	resolver     *digestResolver
+	stats        *ruleStatsFlusher
 }
 
+const (
+	RuleRegistered = "Registered"
+	RuleValid      = "Valid"
+)
+
 //+kubebuilder:rbac:groups=image.lin2ur.cn,resources=rules,verbs=get;list;watch
 //+kubebuilder:rbac:groups=image.lin2ur.cn,resources=rules/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=image.lin2ur.cn,resources=rules/finalizers,verbs=update
+//+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
 //+kubebuilder:rbac:groups=admissionregistration.k8s.io,resources=mutatingwebhookconfigurations,verbs=create;list;watch;get;delete;patch;update
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
@@ -65,21 +83,64 @@ func (r *RuleReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.
 		return ctrl.Result{}, err
 	}
 
+	err := updateMutatingWebhookConfiguration(ctx, r.Client, rules.Items)
+
 	index := slices.IndexFunc(rules.Items, func(rule imagev1.Rule) bool {
 		return rule.Name == req.Name
 	})
 
 	if index >= 0 {
-		r.handlers.Store(req.Name, buildMutateHandler(r.decoder, rules.Items[index]))
+		if statusErr := r.updateStatus(ctx, &rules.Items[index], err); statusErr != nil {
+			logger.Error(statusErr, "unable to update rule status")
+		}
 	} else {
-		r.handlers.Delete(req.Name)
+		// the series of a deleted Rule must not be exported forever
+		deleteRuleMetrics(req.Name)
 	}
 
-	if err := updateMutatingWebhookConfiguration(ctx, r.Client, rules.Items); err != nil {
-		return ctrl.Result{}, err
+	return ctrl.Result{}, err
+}
+
+// updateStatus sets the conditions of rule, registerErr is the result of
+// updating the MutatingWebhookConfiguration.
+func (r *RuleReconciler) updateStatus(ctx context.Context, rule *imagev1.Rule, registerErr error) error {
+	valid := metav1.Condition{
+		Type:    RuleValid,
+		Status:  metav1.ConditionTrue,
+		Reason:  "Compiled",
+		Message: "Rule compiled successfully",
+	}
+
+	if _, err := compileRuleSet(*rule); err != nil {
+		valid.Status = metav1.ConditionFalse
+		valid.Reason = "CompileFailed"
+		valid.Message = err.Error()
+	}
+
+	registered := metav1.Condition{
+		Type:    RuleRegistered,
+		Status:  metav1.ConditionTrue,
+		Reason:  "WebhookRegistered",
+		Message: "Rule is registered in the MutatingWebhookConfiguration",
+	}
+
+	if registerErr != nil {
+		registered.Status = metav1.ConditionFalse
+		registered.Reason = "WebhookRegisterFailed"
+		registered.Message = registerErr.Error()
 	}
 
-	return ctrl.Result{}, nil
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		if err := r.Get(ctx, client.ObjectKeyFromObject(rule), rule); err != nil {
+			return err
+		}
+
+		rule.Status.ObservedGeneration = rule.Generation
+		meta.SetStatusCondition(&rule.Status.Conditions, valid)
+		meta.SetStatusCondition(&rule.Status.Conditions, registered)
+
+		return r.Status().Update(ctx, rule)
+	})
 }
 
 func (r *RuleReconciler) Handle(ctx context.Context, request admission.Request) admission.Response {
@@ -95,6 +156,63 @@ func (r *RuleReconciler) Handle(ctx context.Context, request admission.Request)
 	return admission.Allowed("no handler found")
 }
 
+// ReadyzCheck fails until the mutate handlers have been built from the initial
+// list of rules, so that a replica does not admit pods unmodified right after start.
+func (r *RuleReconciler) ReadyzCheck(_ *http.Request) error {
+	if r.handlersSync == nil || !r.handlersSync.HasSynced() {
+		return errors.New("rule handlers have not synced")
+	}
+
+	return nil
+}
+
+// syncHandlers keeps the mutate handlers in sync with the rules in the cache.
+// Unlike Reconcile, it runs on every replica, whether or not it is the leader.
+func (r *RuleReconciler) syncHandlers(ctx context.Context, mgr ctrl.Manager) (err error) {
+	informer, err := mgr.GetCache().GetInformer(ctx, &imagev1.Rule{})
+	if err != nil {
+		return err
+	}
+
+	store := func(obj interface{}) {
+		if rule, ok := obj.(*imagev1.Rule); ok {
+			rs, err := compileRuleSet(*rule)
+			if err != nil {
+				log.Log.Error(err, "failed to compile rule", "rule", rule.Name)
+			}
+
+			r.handlers.Store(rule.Name, &podMutator{
+				decoder:  r.decoder,
+				rule:     rs,
+				resolver: r.resolver,
+				stats:    r.stats.get(rule.Name),
+				recorder: r.Recorder,
+			})
+		}
+	}
+
+	r.handlersSync, err = informer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc: store,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			// status updates, e.g. the counters, don't change the generation
+			if oldObj.(*imagev1.Rule).Generation != newObj.(*imagev1.Rule).Generation {
+				store(newObj)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(toolscache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+
+			if rule, ok := obj.(*imagev1.Rule); ok {
+				r.handlers.Delete(rule.Name)
+			}
+		},
+	})
+
+	return err
+}
+
 // SetupWithManager sets up the controller with the Manager.
 func (r *RuleReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	var err error
@@ -105,6 +223,19 @@ func (r *RuleReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	}
 
 	r.decoder = admission.NewDecoder(mgr.GetScheme())
+	r.resolver = newDigestResolver(mgr.GetAPIReader())
+	r.stats = &ruleStatsFlusher{
+		client: mgr.GetClient(),
+		reader: mgr.GetAPIReader(),
+	}
+
+	if err := mgr.Add(r.stats); err != nil {
+		return err
+	}
+
+	if err := r.syncHandlers(context.Background(), mgr); err != nil {
+		return err
+	}
 
 	mgr.GetWebhookServer().Register(WebhookPathPrefix, &webhook.Admission{
 		Handler: r,
@@ -118,6 +249,6 @@ func (r *RuleReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	})
 
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&imagev1.Rule{}).
+		For(&imagev1.Rule{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
 		Complete(r)
 }
@@ -0,0 +1,103 @@
+package controller
+
+import (
+	"context"
+	"flag"
+	imagev1 "github.com/yxwuxuanl/k8s-image-operator/api/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ruleStatsFlushInterval = flag.Duration("rule-stats-flush-interval", 30*time.Second, "how often the rule counters are flushed to the rule status")
+
+// ruleStats counts the admissions handled by a rule on this replica since the last flush.
+type ruleStats struct {
+	podsMutated         atomic.Int64
+	containersRewritten atomic.Int64
+	podsDenied          atomic.Int64
+	podsWarned          atomic.Int64
+}
+
+// ruleStatsFlusher adds the counters of every replica to the rule status.
+// It runs on every replica, not only on the leader, since every replica serves the webhook.
+type ruleStatsFlusher struct {
+	client client.Client
+	// reader reads rules from the API server, so that conflicts are resolved with the latest version.
+	reader client.Reader
+
+	stats sync.Map
+}
+
+func (f *ruleStatsFlusher) get(ruleName string) *ruleStats {
+	v, _ := f.stats.LoadOrStore(ruleName, &ruleStats{})
+	return v.(*ruleStats)
+}
+
+func (f *ruleStatsFlusher) NeedLeaderElection() bool {
+	return false
+}
+
+func (f *ruleStatsFlusher) Start(ctx context.Context) error {
+	t := time.NewTicker(*ruleStatsFlushInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			// flush what is left before the replica goes away
+			f.flush(context.Background())
+			return nil
+		case <-t.C:
+			f.flush(ctx)
+		}
+	}
+}
+
+func (f *ruleStatsFlusher) flush(ctx context.Context) {
+	f.stats.Range(func(key, value any) bool {
+		ruleName, stats := key.(string), value.(*ruleStats)
+
+		podsMutated := stats.podsMutated.Swap(0)
+		containersRewritten := stats.containersRewritten.Swap(0)
+		podsDenied := stats.podsDenied.Swap(0)
+		podsWarned := stats.podsWarned.Swap(0)
+
+		if podsMutated == 0 && containersRewritten == 0 && podsDenied == 0 && podsWarned == 0 {
+			return true
+		}
+
+		err := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+			rule := &imagev1.Rule{}
+			if err := f.reader.Get(ctx, client.ObjectKey{Name: ruleName}, rule); err != nil {
+				return err
+			}
+
+			rule.Status.PodsMutated += podsMutated
+			rule.Status.ContainersRewritten += containersRewritten
+			rule.Status.PodsDenied += podsDenied
+			rule.Status.PodsWarned += podsWarned
+
+			return f.client.Status().Update(ctx, rule)
+		})
+
+		switch {
+		case errors.IsNotFound(err):
+			f.stats.Delete(ruleName)
+		case err != nil:
+			log.Log.Error(err, "unable to flush rule stats", "rule", ruleName)
+
+			// keep the counts for the next flush
+			stats.podsMutated.Add(podsMutated)
+			stats.containersRewritten.Add(containersRewritten)
+			stats.podsDenied.Add(podsDenied)
+			stats.podsWarned.Add(podsWarned)
+		}
+
+		return true
+	})
+}
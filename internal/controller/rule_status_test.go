@@ -0,0 +1,80 @@
+package controller
+
+import (
+	"context"
+	imagev1 "github.com/yxwuxuanl/k8s-image-operator/api/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	"testing"
+)
+
+func TestRuleStatsFlushConflict(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = imagev1.AddToScheme(scheme)
+
+	rule := &imagev1.Rule{ObjectMeta: metav1.ObjectMeta{Name: "mirror"}}
+	rule.Status.PodsMutated = 10
+
+	// another replica flushes its counts between the read and the update of the first attempt
+	var conflicts int
+	cli := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(rule).
+		WithStatusSubresource(&imagev1.Rule{}).
+		WithInterceptorFuncs(interceptor.Funcs{
+			SubResourceUpdate: func(ctx context.Context, c client.Client, subResource string, obj client.Object, opts ...client.SubResourceUpdateOption) error {
+				if conflicts == 0 {
+					conflicts++
+
+					current := &imagev1.Rule{}
+					if err := c.Get(ctx, client.ObjectKeyFromObject(obj), current); err != nil {
+						return err
+					}
+
+					current.Status.PodsMutated += 5
+					if err := c.Status().Update(ctx, current); err != nil {
+						return err
+					}
+				}
+
+				return c.SubResource(subResource).Update(ctx, obj, opts...)
+			},
+		}).
+		Build()
+
+	f := &ruleStatsFlusher{client: cli, reader: cli}
+
+	stats := f.get("mirror")
+	stats.podsMutated.Add(2)
+	stats.containersRewritten.Add(3)
+	stats.podsDenied.Add(1)
+
+	// the stats of a deleted rule are dropped
+	f.get("deleted").podsDenied.Add(1)
+
+	f.flush(context.Background())
+
+	if conflicts != 1 {
+		t.Fatalf("conflicts = %d, want the status update to conflict once", conflicts)
+	}
+
+	got := &imagev1.Rule{}
+	if err := cli.Get(context.Background(), client.ObjectKeyFromObject(rule), got); err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Status.PodsMutated != 17 || got.Status.ContainersRewritten != 3 || got.Status.PodsDenied != 1 {
+		t.Errorf("status = %+v, want the counts of both replicas", got.Status)
+	}
+
+	if stats.podsMutated.Load() != 0 || stats.containersRewritten.Load() != 0 || stats.podsDenied.Load() != 0 {
+		t.Error("the flushed counts were kept for the next flush")
+	}
+
+	if _, ok := f.stats.Load("deleted"); ok {
+		t.Error("the stats of the deleted rule were kept")
+	}
+}
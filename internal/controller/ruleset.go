@@ -0,0 +1,232 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	imagev1 "github.com/yxwuxuanl/k8s-image-operator/api/v1"
+	"github.com/yxwuxuanl/k8s-image-operator/internal/reference"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ruleSet is the compiled form of a Rule. It is built once when the Rule
+// changes, so that admission requests only have to run the matching.
+type ruleSet struct {
+	rule imagev1.Rule
+
+	registries     *registryTrie
+	regexes        []compiledRegex
+	disallowedTags map[string]struct{}
+
+	allowedRegistries []registryMatcher
+	deniedRegistries  []registryMatcher
+}
+
+// registryMatcher is a compiled imagev1.RegistryPattern.
+type registryMatcher struct {
+	glob string
+	re   *regexp.Regexp
+}
+
+func (m registryMatcher) match(registry string) bool {
+	if m.re != nil {
+		return m.re.MatchString(registry)
+	}
+
+	ok, _ := filepath.Match(m.glob, registry)
+	return ok
+}
+
+type compiledRegex struct {
+	// index is the position of the rule in spec.rewrite, rules are matched in that order.
+	index       int
+	re          *regexp.Regexp
+	replacement string
+}
+
+// compileRuleSet compiles rule, the returned error reports the rewrite
+// entries that were skipped because they could not be compiled.
+func compileRuleSet(rule imagev1.Rule) (*ruleSet, error) {
+	rs := &ruleSet{
+		rule:           rule,
+		registries:     &registryTrie{index: -1},
+		disallowedTags: make(map[string]struct{}, len(rule.Spec.DisallowedTags)),
+	}
+
+	var errs []error
+	for i, rewrite := range rule.Spec.Rewrite {
+		if rewrite.Registry != "" {
+			rs.registries.insert(rewrite.Registry, i, rewrite.Replacement)
+		}
+
+		if rewrite.Regex != "" {
+			re, err := regexp.Compile(rewrite.Regex)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("rewrite[%d]: %w", i, err))
+				continue
+			}
+
+			rs.regexes = append(rs.regexes, compiledRegex{
+				index:       i,
+				re:          re,
+				replacement: rewrite.Replacement,
+			})
+		}
+	}
+
+	for _, tag := range rule.Spec.DisallowedTags {
+		rs.disallowedTags[tag] = struct{}{}
+	}
+
+	if policy := rule.Spec.Policy; policy != nil {
+		var err error
+		if rs.allowedRegistries, err = compileRegistryPatterns(policy.AllowedRegistries); err != nil {
+			errs = append(errs, fmt.Errorf("policy.allowedRegistries: %w", err))
+		}
+
+		if rs.deniedRegistries, err = compileRegistryPatterns(policy.DeniedRegistries); err != nil {
+			errs = append(errs, fmt.Errorf("policy.deniedRegistries: %w", err))
+		}
+	}
+
+	return rs, errors.Join(errs...)
+}
+
+func compileRegistryPatterns(patterns []imagev1.RegistryPattern) ([]registryMatcher, error) {
+	matchers := make([]registryMatcher, 0, len(patterns))
+
+	for i, pattern := range patterns {
+		if pattern.Regex != "" {
+			// the whole registry must match, example\.com must not allow notexample.com or example.com.evil.io
+			re, err := regexp.Compile(`^(?:` + pattern.Regex + `)$`)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %w", i, err)
+			}
+
+			matchers = append(matchers, registryMatcher{re: re})
+			continue
+		}
+
+		if _, err := filepath.Match(pattern.Glob, ""); err != nil {
+			return nil, fmt.Errorf("[%d]: %w", i, err)
+		}
+
+		matchers = append(matchers, registryMatcher{glob: pattern.Glob})
+	}
+
+	return matchers, nil
+}
+
+// checkRegistry returns an error if the policy of the rule does not allow the registry of ref.
+func (rs *ruleSet) checkRegistry(ref reference.Reference) error {
+	for _, m := range rs.deniedRegistries {
+		if m.match(ref.Domain) {
+			return fmt.Errorf("registry %s is denied", ref.Domain)
+		}
+	}
+
+	if rs.rule.Spec.Policy == nil || len(rs.rule.Spec.Policy.AllowedRegistries) == 0 {
+		return nil
+	}
+
+	for _, m := range rs.allowedRegistries {
+		if m.match(ref.Domain) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("registry %s is not allowed", ref.Domain)
+}
+
+// rewrite returns the image rewritten by the first matching entry of spec.rewrite.
+func (rs *ruleSet) rewrite(ref reference.Reference) (string, bool) {
+	image := ref.String()
+
+	node, prefixLen := rs.registries.match(image)
+
+	for _, regex := range rs.regexes {
+		if node != nil && node.index <= regex.index {
+			break
+		}
+
+		if regex.re.MatchString(image) {
+			return regex.re.ReplaceAllString(image, regex.replacement), true
+		}
+	}
+
+	if node != nil {
+		return node.replacement + image[prefixLen:], true
+	}
+
+	return "", false
+}
+
+func (rs *ruleSet) isDisallowedTag(tag string) bool {
+	_, ok := rs.disallowedTags[tag]
+	return ok
+}
+
+// registryTrie indexes the registry prefixes of spec.rewrite by path segment.
+type registryTrie struct {
+	children map[string]*registryTrie
+
+	// index is the position of the rule in spec.rewrite, or -1 if no rule ends at this node.
+	index       int
+	replacement string
+}
+
+func (t *registryTrie) insert(registry string, index int, replacement string) {
+	node := t
+	for _, segment := range strings.Split(registry, "/") {
+		child, ok := node.children[segment]
+		if !ok {
+			if node.children == nil {
+				node.children = make(map[string]*registryTrie)
+			}
+
+			child = &registryTrie{index: -1}
+			node.children[segment] = child
+		}
+
+		node = child
+	}
+
+	// the first rule wins when a registry is listed more than once
+	if node.index < 0 {
+		node.index = index
+		node.replacement = replacement
+	}
+}
+
+// match returns the earliest rule whose registry is a prefix of image, followed by a '/',
+// together with the length of that prefix.
+func (t *registryTrie) match(image string) (*registryTrie, int) {
+	var (
+		best      *registryTrie
+		prefixLen int
+	)
+
+	node := t
+	for offset := 0; ; {
+		i := strings.IndexByte(image[offset:], '/')
+		if i < 0 {
+			break
+		}
+
+		child, ok := node.children[image[offset:offset+i]]
+		if !ok {
+			break
+		}
+
+		node = child
+		offset += i + 1
+
+		if node.index >= 0 && (best == nil || node.index < best.index) {
+			best = node
+			prefixLen = offset - 1
+		}
+	}
+
+	return best, prefixLen
+}
@@ -0,0 +1,377 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	imagev1 "github.com/yxwuxuanl/k8s-image-operator/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func newRule(rewrite ...imagev1.RewriteRule) imagev1.Rule {
+	rule := imagev1.Rule{}
+	rule.Name = "test"
+	rule.Spec.Rewrite = rewrite
+	return rule
+}
+
+func TestRuleSetRewrite(t *testing.T) {
+	tests := []struct {
+		name    string
+		rewrite []imagev1.RewriteRule
+		image   string
+		want    string
+		matched bool
+	}{
+		{
+			name:    "registry",
+			rewrite: []imagev1.RewriteRule{{Registry: "docker.io", Replacement: "mirror.local"}},
+			image:   "nginx",
+			want:    "mirror.local/library/nginx:latest",
+			matched: true,
+		},
+		{
+			name:    "registry is matched by path segment",
+			rewrite: []imagev1.RewriteRule{{Registry: "docker.io/lib", Replacement: "mirror.local"}},
+			image:   "nginx",
+		},
+		{
+			name: "longer registry prefix listed first",
+			rewrite: []imagev1.RewriteRule{
+				{Registry: "docker.io/library", Replacement: "mirror.local/official"},
+				{Registry: "docker.io", Replacement: "mirror.local"},
+			},
+			image:   "nginx:1.25",
+			want:    "mirror.local/official/nginx:1.25",
+			matched: true,
+		},
+		{
+			name: "shorter registry prefix listed first",
+			rewrite: []imagev1.RewriteRule{
+				{Registry: "docker.io", Replacement: "mirror.local"},
+				{Registry: "docker.io/library", Replacement: "mirror.local/official"},
+			},
+			image:   "nginx:1.25",
+			want:    "mirror.local/library/nginx:1.25",
+			matched: true,
+		},
+		{
+			name:    "regex",
+			rewrite: []imagev1.RewriteRule{{Regex: `^quay\.io/(.*)$`, Replacement: "mirror.local/quay/$1"}},
+			image:   "quay.io/prometheus/node-exporter:v1.7.0",
+			want:    "mirror.local/quay/prometheus/node-exporter:v1.7.0",
+			matched: true,
+		},
+		{
+			name: "regex listed before registry",
+			rewrite: []imagev1.RewriteRule{
+				{Regex: `^docker\.io/library/(.*)$`, Replacement: "regex.local/$1"},
+				{Registry: "docker.io", Replacement: "registry.local"},
+			},
+			image:   "nginx",
+			want:    "regex.local/nginx:latest",
+			matched: true,
+		},
+		{
+			name: "registry listed before regex",
+			rewrite: []imagev1.RewriteRule{
+				{Registry: "docker.io", Replacement: "registry.local"},
+				{Regex: `^docker\.io/library/(.*)$`, Replacement: "regex.local/$1"},
+			},
+			image:   "nginx",
+			want:    "registry.local/library/nginx:latest",
+			matched: true,
+		},
+		{
+			name: "registry and regex in the same entry",
+			rewrite: []imagev1.RewriteRule{
+				{Registry: "docker.io", Regex: `^docker\.io/library/(.*)$`, Replacement: "mirror.local"},
+			},
+			image:   "nginx",
+			want:    "mirror.local/library/nginx:latest",
+			matched: true,
+		},
+		{
+			name: "regex of the same entry applies when the registry does not match",
+			rewrite: []imagev1.RewriteRule{
+				{Registry: "quay.io", Regex: `^docker\.io/library/(.*)$`, Replacement: "mirror.local"},
+			},
+			image:   "nginx",
+			want:    "mirror.local",
+			matched: true,
+		},
+		{
+			name: "no match",
+			rewrite: []imagev1.RewriteRule{
+				{Registry: "quay.io", Replacement: "mirror.local"},
+				{Regex: `^ghcr\.io/`, Replacement: "mirror.local/"},
+			},
+			image: "nginx",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs, err := compileRuleSet(newRule(tt.rewrite...))
+			if err != nil {
+				t.Fatalf("compileRuleSet() error = %v", err)
+			}
+
+			ref, err := normalizeImage(tt.image)
+			if err != nil {
+				t.Fatalf("normalizeImage(%q) error = %v", tt.image, err)
+			}
+
+			got, matched := rs.rewrite(ref)
+			if got != tt.want || matched != tt.matched {
+				t.Errorf("rewrite(%q) = %q, %v, want %q, %v", tt.image, got, matched, tt.want, tt.matched)
+			}
+		})
+	}
+}
+
+func TestCompileRuleSetInvalidRegex(t *testing.T) {
+	rs, err := compileRuleSet(newRule(
+		imagev1.RewriteRule{Regex: `(`, Replacement: "invalid"},
+		imagev1.RewriteRule{Registry: "docker.io", Replacement: "mirror.local"},
+	))
+	if err == nil || !strings.Contains(err.Error(), "rewrite[0]") {
+		t.Fatalf("compileRuleSet() error = %v, want an error for rewrite[0]", err)
+	}
+
+	ref, _ := normalizeImage("nginx")
+	if got, _ := rs.rewrite(ref); got != "mirror.local/library/nginx:latest" {
+		t.Errorf("rewrite() = %q, want the valid entries to still apply", got)
+	}
+}
+
+// benchmarkRewrite returns a rewrite list of n registry and n regex entries,
+// followed by the entries matching the images of benchmarkPod.
+func benchmarkRewrite(n int) []imagev1.RewriteRule {
+	rewrite := make([]imagev1.RewriteRule, 0, 2*n+2)
+	for i := 0; i < n; i++ {
+		rewrite = append(rewrite,
+			imagev1.RewriteRule{
+				Registry:    fmt.Sprintf("registry-%d.example.com", i),
+				Replacement: fmt.Sprintf("mirror.local/registry-%d", i),
+			},
+			imagev1.RewriteRule{
+				Regex:       fmt.Sprintf(`^regex-%d\.example\.com/(.+)$`, i),
+				Replacement: fmt.Sprintf("mirror.local/regex-%d/$1", i),
+			},
+		)
+	}
+
+	return append(rewrite,
+		imagev1.RewriteRule{Regex: `^quay\.io/(.+)$`, Replacement: "mirror.local/quay/$1"},
+		imagev1.RewriteRule{Registry: "docker.io", Replacement: "mirror.local/docker"},
+	)
+}
+
+func benchmarkPod() *corev1.Pod {
+	images := []string{
+		"nginx:1.25",
+		"redis",
+		"bitnami/postgresql:16",
+		"quay.io/prometheus/node-exporter:v1.7.0",
+		"registry.k8s.io/pause:3.9",
+		"gcr.io/distroless/static:nonroot",
+	}
+
+	pod := &corev1.Pod{}
+	for i, image := range images {
+		pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{
+			Name:  fmt.Sprintf("c%d", i),
+			Image: image,
+		})
+	}
+
+	return pod
+}
+
+// rewriteImagePerRequest is the matching done before rules were compiled,
+// every regex is compiled again for each image.
+func rewriteImagePerRequest(image string, rules []imagev1.RewriteRule) (string, bool) {
+	for _, rule := range rules {
+		if rule.Registry != "" && strings.HasPrefix(image, rule.Registry+"/") {
+			return strings.Replace(image, rule.Registry, rule.Replacement, 1), true
+		}
+
+		if rule.Regex != "" {
+			re, err := regexp.Compile(rule.Regex)
+			if err != nil {
+				continue
+			}
+
+			if re.MatchString(image) {
+				return re.ReplaceAllString(image, rule.Replacement), true
+			}
+		}
+	}
+
+	return "", false
+}
+
+func TestRewriteImagePerRequestAgrees(t *testing.T) {
+	rewrite := benchmarkRewrite(10)
+	rs, err := compileRuleSet(newRule(rewrite...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, container := range benchmarkPod().Spec.Containers {
+		ref, err := normalizeImage(container.Image)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, matched := rs.rewrite(ref)
+		want, wantMatched := rewriteImagePerRequest(ref.String(), rewrite)
+		if got != want || matched != wantMatched {
+			t.Errorf("rewrite(%q) = %q, %v, per request %q, %v", ref, got, matched, want, wantMatched)
+		}
+	}
+}
+
+func BenchmarkMutatePod(b *testing.B) {
+	ctx := context.Background()
+
+	for _, n := range []int{100, 250, 500} {
+		rewrite := benchmarkRewrite(n)
+
+		b.Run(fmt.Sprintf("compiled/entries=%d", len(rewrite)), func(b *testing.B) {
+			rs, err := compileRuleSet(newRule(rewrite...))
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			pod, oldPod := benchmarkPod(), &corev1.Pod{}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := mutatePod(ctx, rs, nil, pod, oldPod); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("per-request/entries=%d", len(rewrite)), func(b *testing.B) {
+			pod := benchmarkPod()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _, container := range pod.Spec.Containers {
+					ref, err := normalizeImage(container.Image)
+					if err != nil {
+						b.Fatal(err)
+					}
+
+					rewriteImagePerRequest(ref.String(), rewrite)
+				}
+			}
+		})
+	}
+}
+
+func TestRuleSetCheckRegistry(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  imagev1.RegistryPolicy
+		image   string
+		allowed bool
+	}{
+		{
+			name:    "glob",
+			policy:  imagev1.RegistryPolicy{AllowedRegistries: []imagev1.RegistryPattern{{Glob: "*.example.com"}}},
+			image:   "mirror.example.com/nginx:1.25",
+			allowed: true,
+		},
+		{
+			name:   "glob does not match",
+			policy: imagev1.RegistryPolicy{AllowedRegistries: []imagev1.RegistryPattern{{Glob: "*.example.com"}}},
+			image:  "nginx:1.25",
+		},
+		{
+			name:    "anchored regex",
+			policy:  imagev1.RegistryPolicy{AllowedRegistries: []imagev1.RegistryPattern{{Regex: `^registry\.example\.com(:\d+)?$`}}},
+			image:   "registry.example.com:5000/nginx:1.25",
+			allowed: true,
+		},
+		{
+			name:    "unanchored regex matches the whole registry",
+			policy:  imagev1.RegistryPolicy{AllowedRegistries: []imagev1.RegistryPattern{{Regex: `example\.com`}}},
+			image:   "example.com/nginx:1.25",
+			allowed: true,
+		},
+		{
+			name:   "suffix bypass",
+			policy: imagev1.RegistryPolicy{AllowedRegistries: []imagev1.RegistryPattern{{Regex: `example\.com`}}},
+			image:  "example.com.evil.io/nginx:1.25",
+		},
+		{
+			name:   "prefix bypass",
+			policy: imagev1.RegistryPolicy{AllowedRegistries: []imagev1.RegistryPattern{{Regex: `example\.com`}}},
+			image:  "notexample.com/nginx:1.25",
+		},
+		{
+			name: "deny overrides allow",
+			policy: imagev1.RegistryPolicy{
+				AllowedRegistries: []imagev1.RegistryPattern{{Glob: "*.example.com"}},
+				DeniedRegistries:  []imagev1.RegistryPattern{{Glob: "untrusted.example.com"}},
+			},
+			image: "untrusted.example.com/nginx:1.25",
+		},
+		{
+			name:    "only denied registries",
+			policy:  imagev1.RegistryPolicy{DeniedRegistries: []imagev1.RegistryPattern{{Glob: "docker.io"}}},
+			image:   "quay.io/prometheus/node-exporter:v1.7.0",
+			allowed: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := newRule()
+			rule.Spec.Policy = &tt.policy
+
+			rs, err := compileRuleSet(rule)
+			if err != nil {
+				t.Fatalf("compileRuleSet() error = %v", err)
+			}
+
+			ref, err := normalizeImage(tt.image)
+			if err != nil {
+				t.Fatalf("normalizeImage(%q) error = %v", tt.image, err)
+			}
+
+			if err := rs.checkRegistry(ref); (err == nil) != tt.allowed {
+				t.Errorf("checkRegistry(%q) = %v, want allowed %v", tt.image, err, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestMutatePodRegistryPolicy(t *testing.T) {
+	rule := newRule(imagev1.RewriteRule{Registry: "docker.io", Replacement: "example.com.evil.io"})
+	rule.Spec.Policy = &imagev1.RegistryPolicy{AllowedRegistries: []imagev1.RegistryPattern{{Regex: `example\.com`}}}
+
+	rs, err := compileRuleSet(rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pod := &corev1.Pod{}
+	pod.Spec.Containers = []corev1.Container{{Name: "app", Image: "nginx:1.25"}}
+
+	_, err = mutatePod(context.Background(), rs, nil, pod, &corev1.Pod{})
+
+	var denial *denyError
+	if !errors.As(err, &denial) || denial.reason != DenyReasonRegistryPolicy {
+		t.Errorf("mutatePod() error = %v, want a %s denial", err, DenyReasonRegistryPolicy)
+	}
+}
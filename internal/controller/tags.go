@@ -0,0 +1,140 @@
+package controller
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/Masterminds/semver/v3"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	apiv1 "github.com/yxwuxuanl/k8s-image-operator/api/v1"
+	"github.com/yxwuxuanl/k8s-image-operator/internal/reference"
+	"regexp"
+	"slices"
+	"sort"
+	"time"
+)
+
+var tagListTimeout = flag.Duration("tag-list-timeout", 30*time.Second, "timeout for listing the tags of a repository")
+
+// listTags returns the tags of the repository of ref.
+func (d *digestResolver) listTags(ctx context.Context, ref reference.Reference, keychain authn.Keychain) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, *tagListTimeout)
+	defer cancel()
+
+	repo, err := name.NewRepository(ref.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := remote.List(repo, d.options(ctx, keychain)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tags of %s: %w", ref.Name(), err)
+	}
+
+	return tags, nil
+}
+
+// selectTags returns the tags matched by selector, sorted by version when
+// the selector uses versions and by name otherwise.
+func selectTags(tags []string, selector *apiv1.TagSelector) ([]string, error) {
+	var (
+		include  *regexp.Regexp
+		excludes []*regexp.Regexp
+		versions *semver.Constraints
+		err      error
+	)
+
+	if selector.Regex != "" {
+		if include, err = regexp.Compile(selector.Regex); err != nil {
+			return nil, fmt.Errorf("regex: %w", err)
+		}
+	}
+
+	for i, exclude := range selector.Exclude {
+		re, err := regexp.Compile(exclude)
+		if err != nil {
+			return nil, fmt.Errorf("exclude[%d]: %w", i, err)
+		}
+
+		excludes = append(excludes, re)
+	}
+
+	if selector.SemverRange != "" {
+		if versions, err = semver.NewConstraint(selector.SemverRange); err != nil {
+			return nil, fmt.Errorf("semverRange: %w", err)
+		}
+	}
+
+	bySemver := versions != nil || selector.Latest != nil
+
+	var (
+		selected []string
+		parsed   = make(map[string]*semver.Version)
+	)
+
+	for _, tag := range tags {
+		if include != nil && !include.MatchString(tag) {
+			continue
+		}
+
+		if slices.ContainsFunc(excludes, func(re *regexp.Regexp) bool { return re.MatchString(tag) }) {
+			continue
+		}
+
+		if bySemver {
+			version, err := semver.NewVersion(tag)
+			if err != nil {
+				continue
+			}
+
+			if versions != nil && !versions.Check(version) {
+				continue
+			}
+
+			parsed[tag] = version
+		}
+
+		selected = append(selected, tag)
+	}
+
+	if !bySemver {
+		sort.Strings(selected)
+		return selected, nil
+	}
+
+	// highest version first, so that latest only has to truncate
+	sort.SliceStable(selected, func(i, j int) bool {
+		return parsed[selected[i]].GreaterThan(parsed[selected[j]])
+	})
+
+	if latest := selector.Latest; latest != nil && len(selected) > int(*latest) {
+		selected = selected[:*latest]
+	}
+
+	return selected, nil
+}
+
+// mirrorImages returns the images of mirror, with the tags resolved from their tagSelector added to their tags.
+func mirrorImages(mirror *apiv1.Mirror) []apiv1.MirrorImage {
+	images := make([]apiv1.MirrorImage, len(mirror.Spec.Images))
+	for i := range mirror.Spec.Images {
+		mirror.Spec.Images[i].DeepCopyInto(&images[i])
+	}
+
+	for _, resolved := range mirror.Status.ResolvedTags {
+		if int(resolved.Image) >= len(images) {
+			continue
+		}
+
+		image := &images[resolved.Image]
+		for _, tag := range resolved.Tags {
+			if !slices.Contains(image.Tags, tag) {
+				image.Tags = append(image.Tags, tag)
+			}
+		}
+	}
+
+	return images
+}
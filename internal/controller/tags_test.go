@@ -0,0 +1,83 @@
+package controller
+
+import (
+	apiv1 "github.com/yxwuxuanl/k8s-image-operator/api/v1"
+	"k8s.io/utils/ptr"
+	"slices"
+	"testing"
+)
+
+func TestSelectTags(t *testing.T) {
+	tags := []string{"latest", "1.24.0", "1.25.3", "v1.25.4", "1.26.0-rc.1", "1.26.0", "1.26.0-alpine", "stable", "2.0.0"}
+
+	tests := []struct {
+		name     string
+		selector apiv1.TagSelector
+		want     []string
+		wantErr  bool
+	}{
+		{
+			name:     "regex sorted by name",
+			selector: apiv1.TagSelector{Regex: `^[a-z]+$`},
+			want:     []string{"latest", "stable"},
+		},
+		{
+			name:     "exclude",
+			selector: apiv1.TagSelector{Regex: `^1\.2`, Exclude: []string{`-rc`, `-alpine$`}},
+			want:     []string{"1.24.0", "1.25.3", "1.26.0"},
+		},
+		{
+			name:     "semver range drops non-version tags",
+			selector: apiv1.TagSelector{SemverRange: ">=1.25 <2"},
+			want:     []string{"1.26.0", "v1.25.4", "1.25.3"},
+		},
+		{
+			// pre-releases are below their release and compared by their identifiers
+			name:     "latest sorted by version",
+			selector: apiv1.TagSelector{Latest: ptr.To(int32(3))},
+			want:     []string{"2.0.0", "1.26.0", "1.26.0-rc.1"},
+		},
+		{
+			name:     "latest within the range",
+			selector: apiv1.TagSelector{SemverRange: "~1.25", Latest: ptr.To(int32(1))},
+			want:     []string{"v1.25.4"},
+		},
+		{
+			name:     "regex, exclude and latest",
+			selector: apiv1.TagSelector{Regex: `^1\.26`, Exclude: []string{`-rc`}, Latest: ptr.To(int32(5))},
+			want:     []string{"1.26.0", "1.26.0-alpine"},
+		},
+		{
+			name:     "nothing matches",
+			selector: apiv1.TagSelector{SemverRange: ">=3"},
+		},
+		{
+			name:     "invalid regex",
+			selector: apiv1.TagSelector{Regex: `(`},
+			wantErr:  true,
+		},
+		{
+			name:     "invalid exclude",
+			selector: apiv1.TagSelector{Exclude: []string{`[`}},
+			wantErr:  true,
+		},
+		{
+			name:     "invalid semver range",
+			selector: apiv1.TagSelector{SemverRange: "latest"},
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := selectTags(tags, &tt.selector)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("selectTags() error = %v, want error %v", err, tt.wantErr)
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("selectTags() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+// Package reference parses image references following the grammar of
+// github.com/distribution/reference:
+//
+//	reference  := name [ ":" tag ] [ "@" digest ]
+//	name       := [domain '/'] remote-name
+//	domain     := host [':' port-number]
+//	remote-name := path-component ['/' path-component]*
+package reference
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+const (
+	// DefaultDomain is the registry assumed for references without a domain.
+	DefaultDomain = "docker.io"
+	// DefaultTag is the tag assumed for references without a tag or a digest.
+	DefaultTag = "latest"
+
+	legacyDefaultDomain = "index.docker.io"
+	officialRepoPrefix  = "library/"
+	nameTotalLengthMax  = 255
+)
+
+var (
+	ErrReferenceInvalidFormat = errors.New("invalid reference format")
+	ErrNameContainsUppercase  = errors.New("repository name must be lowercase")
+	ErrNameTooLong            = errors.New("repository name must not be more than 255 characters")
+	ErrTagInvalidFormat       = errors.New("invalid tag format")
+	ErrDigestInvalidFormat    = errors.New("invalid digest format")
+	ErrDomainInvalidFormat    = errors.New("invalid domain format")
+)
+
+const (
+	alphanumeric    = `[a-z0-9]+`
+	separator       = `(?:[._]|__|[-]+)`
+	pathComponent   = alphanumeric + `(?:` + separator + alphanumeric + `)*`
+	remoteName      = pathComponent + `(?:/` + pathComponent + `)*`
+	domainComponent = `(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])`
+	domainName      = domainComponent + `(?:\.` + domainComponent + `)*`
+	ipv6Address     = `\[(?:[a-fA-F0-9:]+)\]`
+	host            = `(?:` + domainName + `|` + ipv6Address + `)`
+	domainAndPort   = host + `(?::[0-9]+)?`
+	tag             = `[\w][\w.-]{0,127}`
+	digest          = `[A-Za-z][A-Za-z0-9]*(?:[-_+.][A-Za-z][A-Za-z0-9]*)*:[0-9a-fA-F]{32,}`
+)
+
+var (
+	referenceRegexp = regexp.MustCompile(`^((?:` + domainAndPort + `/)?` + remoteName + `)(?::(` + tag + `))?(?:@(` + digest + `))?$`)
+	domainRegexp    = regexp.MustCompile(`^` + domainAndPort + `$`)
+	tagRegexp       = regexp.MustCompile(`^` + tag + `$`)
+	digestRegexp    = regexp.MustCompile(`^` + digest + `$`)
+)
+
+// Reference is a parsed image reference.
+type Reference struct {
+	// Domain is the registry host, including the port if any. It is empty
+	// when the reference does not name a registry and has not been normalized.
+	Domain string
+	// Path is the repository path within the registry.
+	Path   string
+	Tag    string
+	Digest string
+}
+
+// Parse parses s as written, without filling in the default registry or tag.
+func Parse(s string) (Reference, error) {
+	matches := referenceRegexp.FindStringSubmatch(s)
+	if matches == nil {
+		if s == "" {
+			return Reference{}, ErrReferenceInvalidFormat
+		}
+
+		if referenceRegexp.MatchString(strings.ToLower(s)) {
+			return Reference{}, ErrNameContainsUppercase
+		}
+
+		return Reference{}, ErrReferenceInvalidFormat
+	}
+
+	if len(matches[1]) > nameTotalLengthMax {
+		return Reference{}, ErrNameTooLong
+	}
+
+	ref := Reference{
+		Tag:    matches[2],
+		Digest: matches[3],
+	}
+
+	ref.Domain, ref.Path = splitDomain(matches[1])
+	return ref, nil
+}
+
+// ParseNormalized parses s the way the container runtime does, so that
+// "nginx" and "docker.io/library/nginx" yield the same reference.
+func ParseNormalized(s string) (Reference, error) {
+	ref, err := Parse(s)
+	if err != nil {
+		return Reference{}, err
+	}
+
+	if ref.Domain == "" || ref.Domain == legacyDefaultDomain {
+		ref.Domain = DefaultDomain
+	}
+
+	if ref.Domain == DefaultDomain && !strings.ContainsRune(ref.Path, '/') {
+		ref.Path = officialRepoPrefix + ref.Path
+	}
+
+	return ref, nil
+}
+
+// ValidateDomain checks that s is a registry host with an optional port.
+func ValidateDomain(s string) error {
+	if !domainRegexp.MatchString(s) {
+		return ErrDomainInvalidFormat
+	}
+
+	return nil
+}
+
+// ValidateTag checks that s is a valid tag.
+func ValidateTag(s string) error {
+	if !tagRegexp.MatchString(s) {
+		return ErrTagInvalidFormat
+	}
+
+	return nil
+}
+
+// ValidateDigest checks that s is a valid digest, e.g. sha256:<hex>.
+func ValidateDigest(s string) error {
+	if !digestRegexp.MatchString(s) {
+		return ErrDigestInvalidFormat
+	}
+
+	return nil
+}
+
+// splitDomain applies the same heuristic as the docker CLI: the first path
+// component is a registry if it contains a '.' or a ':', is "localhost", or
+// contains uppercase letters, which are not allowed in repository paths.
+func splitDomain(name string) (domain, path string) {
+	i := strings.IndexRune(name, '/')
+	if i == -1 {
+		return "", name
+	}
+
+	first := name[:i]
+	if strings.ContainsAny(first, ".:") || first == "localhost" || strings.ToLower(first) != first {
+		return first, name[i+1:]
+	}
+
+	return "", name
+}
+
+// Hostname returns the registry host without the port.
+func (r Reference) Hostname() string {
+	if i := r.portIndex(); i >= 0 {
+		return r.Domain[:i]
+	}
+
+	return r.Domain
+}
+
+// Port returns the registry port, or an empty string if there is none.
+func (r Reference) Port() string {
+	if i := r.portIndex(); i >= 0 {
+		return r.Domain[i+1:]
+	}
+
+	return ""
+}
+
+func (r Reference) portIndex() int {
+	i := strings.LastIndexByte(r.Domain, ':')
+	if i < 0 || i < strings.LastIndexByte(r.Domain, ']') {
+		return -1
+	}
+
+	return i
+}
+
+// Name returns the repository name, including the registry if any.
+func (r Reference) Name() string {
+	if r.Domain == "" {
+		return r.Path
+	}
+
+	return r.Domain + "/" + r.Path
+}
+
+// String returns the full reference.
+func (r Reference) String() string {
+	s := r.Name()
+
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+
+	return s
+}
+
+// WithTag returns a copy of the reference with the given tag.
+func (r Reference) WithTag(tag string) Reference {
+	r.Tag = tag
+	return r
+}
+
+// WithDigest returns a copy of the reference with the given digest.
+func (r Reference) WithDigest(digest string) Reference {
+	r.Digest = digest
+	return r
+}
+
+// WithDefaultTag returns a copy of the reference tagged with DefaultTag if it
+// has neither a tag nor a digest.
+func (r Reference) WithDefaultTag() Reference {
+	if r.Tag == "" && r.Digest == "" {
+		r.Tag = DefaultTag
+	}
+
+	return r
+}
@@ -0,0 +1,234 @@
+package reference
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+const testDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input    string
+		want     Reference
+		hostname string
+		port     string
+		err      error
+	}{
+		{
+			input: "nginx",
+			want:  Reference{Path: "nginx"},
+		},
+		{
+			input: "nginx:1.25",
+			want:  Reference{Path: "nginx", Tag: "1.25"},
+		},
+		{
+			input: "library/nginx",
+			want:  Reference{Path: "library/nginx"},
+		},
+		{
+			input:    "myregistry:5000/app",
+			want:     Reference{Domain: "myregistry:5000", Path: "app"},
+			hostname: "myregistry",
+			port:     "5000",
+		},
+		{
+			input:    "myregistry:5000/team/app:v1",
+			want:     Reference{Domain: "myregistry:5000", Path: "team/app", Tag: "v1"},
+			hostname: "myregistry",
+			port:     "5000",
+		},
+		{
+			input:    "localhost/app",
+			want:     Reference{Domain: "localhost", Path: "app"},
+			hostname: "localhost",
+		},
+		{
+			input:    "registry.example.com/app",
+			want:     Reference{Domain: "registry.example.com", Path: "app"},
+			hostname: "registry.example.com",
+		},
+		{
+			input:    "[::1]:5000/app:tag",
+			want:     Reference{Domain: "[::1]:5000", Path: "app", Tag: "tag"},
+			hostname: "[::1]",
+			port:     "5000",
+		},
+		{
+			input:    "[::1]/app",
+			want:     Reference{Domain: "[::1]", Path: "app"},
+			hostname: "[::1]",
+		},
+		{
+			input: "nginx@" + testDigest,
+			want:  Reference{Path: "nginx", Digest: testDigest},
+		},
+		{
+			input: "repo:tag@" + testDigest,
+			want:  Reference{Path: "repo", Tag: "tag", Digest: testDigest},
+		},
+		{
+			input:    "myregistry:5000/repo:tag@" + testDigest,
+			want:     Reference{Domain: "myregistry:5000", Path: "repo", Tag: "tag", Digest: testDigest},
+			hostname: "myregistry",
+			port:     "5000",
+		},
+		{
+			input: "Nginx",
+			err:   ErrNameContainsUppercase,
+		},
+		{
+			input: "library/Nginx:latest",
+			err:   ErrNameContainsUppercase,
+		},
+		{
+			input:    "Registry.Example.com/app",
+			want:     Reference{Domain: "Registry.Example.com", Path: "app"},
+			hostname: "Registry.Example.com",
+		},
+		{
+			input: strings.Repeat("a", 256),
+			err:   ErrNameTooLong,
+		},
+		{
+			input: strings.Repeat("a", 255),
+			want:  Reference{Path: strings.Repeat("a", 255)},
+		},
+		{
+			input: "",
+			err:   ErrReferenceInvalidFormat,
+		},
+		{
+			input: "nginx:",
+			err:   ErrReferenceInvalidFormat,
+		},
+		{
+			input: "nginx@sha256:abc",
+			err:   ErrReferenceInvalidFormat,
+		},
+		{
+			input: "myregistry:port/app",
+			err:   ErrReferenceInvalidFormat,
+		},
+		{
+			input: "nginx:" + strings.Repeat("a", 129),
+			err:   ErrReferenceInvalidFormat,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := Parse(tt.input)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("Parse(%q) error = %v, want %v", tt.input, err, tt.err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Parse(%q) error = %v", tt.input, err)
+			}
+
+			if got != tt.want {
+				t.Errorf("Parse(%q) = %+v, want %+v", tt.input, got, tt.want)
+			}
+
+			if got.String() != tt.input {
+				t.Errorf("Parse(%q).String() = %q", tt.input, got.String())
+			}
+
+			if got.Hostname() != tt.hostname || got.Port() != tt.port {
+				t.Errorf("Parse(%q) hostname, port = %q, %q, want %q, %q", tt.input, got.Hostname(), got.Port(), tt.hostname, tt.port)
+			}
+		})
+	}
+}
+
+func TestParseNormalized(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: "nginx", want: "docker.io/library/nginx"},
+		{input: "nginx:1.25", want: "docker.io/library/nginx:1.25"},
+		{input: "library/nginx", want: "docker.io/library/nginx"},
+		{input: "docker.io/nginx", want: "docker.io/library/nginx"},
+		{input: "index.docker.io/nginx", want: "docker.io/library/nginx"},
+		{input: "index.docker.io/bitnami/redis", want: "docker.io/bitnami/redis"},
+		{input: "bitnami/redis:7", want: "docker.io/bitnami/redis:7"},
+		{input: "nginx@" + testDigest, want: "docker.io/library/nginx@" + testDigest},
+		{input: "myregistry:5000/app", want: "myregistry:5000/app"},
+		{input: "localhost/app", want: "localhost/app"},
+		{input: "quay.io/prometheus/node-exporter", want: "quay.io/prometheus/node-exporter"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseNormalized(tt.input)
+			if err != nil {
+				t.Fatalf("ParseNormalized(%q) error = %v", tt.input, err)
+			}
+
+			if got.String() != tt.want {
+				t.Errorf("ParseNormalized(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithDefaultTag(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: "nginx", want: "nginx:latest"},
+		{input: "nginx:1.25", want: "nginx:1.25"},
+		{input: "nginx@" + testDigest, want: "nginx@" + testDigest},
+		{input: "myregistry:5000/app", want: "myregistry:5000/app:latest"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			ref, err := Parse(tt.input)
+			if err != nil {
+				t.Fatalf("Parse(%q) error = %v", tt.input, err)
+			}
+
+			if got := ref.WithDefaultTag().String(); got != tt.want {
+				t.Errorf("WithDefaultTag() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		validate func(string) error
+		input    string
+		valid    bool
+	}{
+		{name: "domain", validate: ValidateDomain, input: "registry.example.com", valid: true},
+		{name: "domain with port", validate: ValidateDomain, input: "myregistry:5000", valid: true},
+		{name: "ipv6 domain", validate: ValidateDomain, input: "[::1]:5000", valid: true},
+		{name: "domain with path", validate: ValidateDomain, input: "registry.example.com/app"},
+		{name: "domain with scheme", validate: ValidateDomain, input: "https://registry.example.com"},
+		{name: "tag", validate: ValidateTag, input: "v1.2.3-rc.1", valid: true},
+		{name: "tag starting with a dot", validate: ValidateTag, input: ".v1"},
+		{name: "tag too long", validate: ValidateTag, input: strings.Repeat("a", 129)},
+		{name: "digest", validate: ValidateDigest, input: testDigest, valid: true},
+		{name: "digest too short", validate: ValidateDigest, input: "sha256:abc"},
+		{name: "digest without algorithm", validate: ValidateDigest, input: strings.TrimPrefix(testDigest, "sha256:")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.validate(tt.input); (err == nil) != tt.valid {
+				t.Errorf("validate(%q) error = %v, want valid %v", tt.input, err, tt.valid)
+			}
+		})
+	}
+}